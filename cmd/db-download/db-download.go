@@ -4,10 +4,12 @@ import (
 
 	// "fmt"
 	"bytes"
+	"context"
 	"database/sql"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	// "path/filepath"
 
@@ -18,6 +20,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/thought-machine/go-flags"
 	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/tools/clientcmd"
@@ -27,10 +30,22 @@ import (
 )
 
 type Options struct {
-	KubeConfig string `long:"kubeconfig" description:"(optional) absolute path to the kubeconfig file"`
-	FileName   string `long:"filename" description:"name of the sqlite3 database file to test with" default:"/home/richardf/gitclones/kube-sqlite3-vfs/file2.db"`
-	Verbose    bool   `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
-	Retries    int    `long:"retries" description:"Number of retries for API calls" default:"1"`
+	KubeConfig          string        `long:"kubeconfig" description:"(optional) absolute path to the kubeconfig file"`
+	FileName            string        `long:"filename" description:"name of the sqlite3 database file to test with" default:"/home/richardf/gitclones/kube-sqlite3-vfs/file2.db"`
+	Verbose             bool          `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
+	Retries             int           `long:"retries" description:"Number of retries for API calls" default:"1"`
+	Storage             string        `long:"storage" description:"Where to store files" choice:"configmap" choice:"secret" choice:"crd" default:"configmap"`
+	ReadCache           int           `long:"read-cache" description:"Number of sectors to cache in memory for reads, 0 disables the cache" default:"256"`
+	EncryptionKeyFile   string        `long:"encryption-key-file" description:"File holding the key to encrypt sectors with, raw or base64"`
+	EncryptionKeyEnv    string        `long:"encryption-key-env" description:"Environment variable holding the key to encrypt sectors with, base64"`
+	EncryptionKeySecret string        `long:"encryption-key-secret" description:"Secret holding encryption keys, each under its key ID"`
+	EncryptionKeyID     string        `long:"encryption-key-id" description:"ID of the key to encrypt new sectors with" default:"default"`
+	OpTimeout           time.Duration `long:"op-timeout" description:"How long each API call can take, 0 for no limit" default:"30s"`
+	APIQPS              float64       `long:"api-qps" description:"Most calls per second to make to the API server, 0 for no limit"`
+	APIBurst            int           `long:"api-burst" description:"How many API calls can be made at once within --api-qps" default:"10"`
+	APIFailFast         bool          `long:"api-fail-fast" description:"Fail API calls which would go over --api-qps rather than waiting"`
+	ReadConcurrency     int           `long:"read-concurrency" description:"Number of sectors each read fetches at once" default:"8"`
+	ReadAhead           int           `long:"read-ahead" description:"Number of sectors to fetch ahead of sequential reads into the read cache, 0 disables it" default:"0"`
 }
 
 func main() {
@@ -87,7 +102,27 @@ func main() {
 		logger.Panic(err)
 	}
 
-	vfsN := vfs.NewVFS(clientset, "test", logger, opts.Retries)
+	dc, err := dynamic.NewForConfig(config)
+	if err != nil {
+		logger.Panic(err)
+	}
+	store, err := vfs.NewStore(vfs.Storage(opts.Storage), clientset, dc, "test", logger)
+	if err != nil {
+		logger.Panic(err)
+	}
+	vfsOpts := []vfs.Option{vfs.WithSectorStore(store), vfs.WithOpTimeout(opts.OpTimeout), vfs.WithReadConcurrency(opts.ReadConcurrency), vfs.WithReadAhead(opts.ReadAhead), vfs.WithRateLimit(vfs.RateLimit{QPS: opts.APIQPS, Burst: opts.APIBurst, FailFast: opts.APIFailFast}), vfs.WithReadCache(opts.ReadCache)}
+	// Loading keys from a Secret is retried like everything else
+	retry := vfs.DefaultRetryPolicy
+	retry.Retries = opts.Retries
+	keyOpts := append([]vfs.Option{vfs.WithRetryPolicy(retry)}, vfsOpts...)
+	keyring, err := vfs.KeySource{File: opts.EncryptionKeyFile, Env: opts.EncryptionKeyEnv, Secret: opts.EncryptionKeySecret, CurrentID: opts.EncryptionKeyID}.Keyring(context.TODO(), clientset, "test", keyOpts...)
+	if err != nil {
+		logger.Panic(err)
+	}
+	if keyring != nil {
+		vfsOpts = append(vfsOpts, vfs.WithEncryption(keyring))
+	}
+	vfsN := vfs.NewVFS(clientset, "test", logger, opts.Retries, vfsOpts...)
 
 	fn := "file2.db"
 
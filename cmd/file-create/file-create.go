@@ -19,6 +19,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/thought-machine/go-flags"
 	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/tools/clientcmd"
@@ -30,8 +31,9 @@ import (
 type Options struct {
 	KubeConfig string `long:"kubeconfig" description:"(optional) absolute path to the kubeconfig file"`
 	// FileName   string `long:"filename" description:"name of the sqlite3 database file to test with" default:"/home/richardf/gitclones/kube-sqlite3-vfs/file2.db"`
-	Verbose bool `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
-	Retries int  `long:"retries" description:"Number of retries for API calls" default:"1"`
+	Verbose bool   `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
+	Retries int    `long:"retries" description:"Number of retries for API calls" default:"1"`
+	Storage string `long:"storage" description:"Where to store files" choice:"configmap" choice:"secret" choice:"crd" default:"configmap"`
 }
 
 func main() {
@@ -90,7 +92,15 @@ func main() {
 		logger.Panic(err)
 	}
 
-	vfsN := vfs.NewVFS(clientset, "test", logger, opts.Retries)
+	dc, err := dynamic.NewForConfig(config)
+	if err != nil {
+		logger.Panic(err)
+	}
+	store, err := vfs.NewStore(vfs.Storage(opts.Storage), clientset, dc, "test", logger)
+	if err != nil {
+		logger.Panic(err)
+	}
+	vfsN := vfs.NewVFS(clientset, "test", logger, opts.Retries, vfs.WithSectorStore(store))
 
 	fn := "fakefile.txt"
 
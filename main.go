@@ -3,10 +3,12 @@ package main
 import (
 
 	// "fmt"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"path/filepath"
+	"time"
 
 	// "path/filepath"
 
@@ -17,6 +19,7 @@ import (
 	"github.com/psanford/sqlite3vfs"
 	"github.com/thought-machine/go-flags"
 	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/tools/clientcmd"
@@ -26,9 +29,28 @@ import (
 )
 
 type Options struct {
-	KubeConfig string `long:"kubeconfig" description:"(optional) absolute path to the kubeconfig file"`
-	Verbose    bool   `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
-	Retries    int    `long:"retries" description:"Number of retries for API calls" default:"1"`
+	KubeConfig          string        `long:"kubeconfig" description:"(optional) absolute path to the kubeconfig file"`
+	Verbose             bool          `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
+	Retries             int           `long:"retries" description:"Number of retries for API calls" default:"1"`
+	Storage             string        `long:"storage" description:"Where to store files" choice:"configmap" choice:"secret" choice:"crd" default:"configmap"`
+	CopyOnWrite         bool          `long:"copy-on-write" description:"Only make writes visible on sync, so nobody sees a half written file"`
+	WAL                 bool          `long:"wal" description:"Use WAL mode so readers don't wait for writers, every connection to the database must be in this process"`
+	ExclusiveProcess    bool          `long:"exclusive-process" description:"Hold a Lease on the database and keep its locks in memory, for when this process is its only user"`
+	WriteBuffer         int           `long:"write-buffer" description:"Number of changed sectors per file to keep in memory until sync, 0 writes them immediately" default:"256"`
+	ReadCache           int           `long:"read-cache" description:"Number of sectors to cache in memory for reads, 0 disables the cache" default:"256"`
+	SectorSize          int64         `long:"sector-size" description:"Bytes per sector object for new files, up to 921600" default:"65536"`
+	SparseZeros         bool          `long:"sparse-zeros" description:"Delete sectors which are all zeros rather than storing them"`
+	Compression         string        `long:"compression" description:"How to compress sectors when writing them" choice:"none" choice:"gzip" default:"none"`
+	EncryptionKeyFile   string        `long:"encryption-key-file" description:"File holding the key to encrypt sectors with, raw or base64"`
+	EncryptionKeyEnv    string        `long:"encryption-key-env" description:"Environment variable holding the key to encrypt sectors with, base64"`
+	EncryptionKeySecret string        `long:"encryption-key-secret" description:"Secret holding encryption keys, each under its key ID"`
+	EncryptionKeyID     string        `long:"encryption-key-id" description:"ID of the key to encrypt new sectors with" default:"default"`
+	OpTimeout           time.Duration `long:"op-timeout" description:"How long each API call can take, 0 for no limit" default:"30s"`
+	APIQPS              float64       `long:"api-qps" description:"Most calls per second to make to the API server, 0 for no limit"`
+	APIBurst            int           `long:"api-burst" description:"How many API calls can be made at once within --api-qps" default:"10"`
+	APIFailFast         bool          `long:"api-fail-fast" description:"Fail API calls which would go over --api-qps rather than waiting"`
+	ReadConcurrency     int           `long:"read-concurrency" description:"Number of sectors each read fetches at once" default:"8"`
+	ReadAhead           int           `long:"read-ahead" description:"Number of sectors to fetch ahead of sequential reads into the read cache, 0 disables it" default:"0"`
 }
 
 func main() {
@@ -85,7 +107,37 @@ func main() {
 		logger.Panic(err)
 	}
 
-	vfsN := vfs.NewVFS(clientset, "test", logger, opts.Retries)
+	dc, err := dynamic.NewForConfig(config)
+	if err != nil {
+		logger.Panic(err)
+	}
+	store, err := vfs.NewStore(vfs.Storage(opts.Storage), clientset, dc, "test", logger)
+	if err != nil {
+		logger.Panic(err)
+	}
+	vfsOpts := []vfs.Option{vfs.WithSectorStore(store), vfs.WithOpTimeout(opts.OpTimeout), vfs.WithReadConcurrency(opts.ReadConcurrency), vfs.WithReadAhead(opts.ReadAhead), vfs.WithRateLimit(vfs.RateLimit{QPS: opts.APIQPS, Burst: opts.APIBurst, FailFast: opts.APIFailFast}), vfs.WithWriteBuffer(opts.WriteBuffer), vfs.WithReadCache(opts.ReadCache), vfs.WithSectorSize(opts.SectorSize), vfs.WithCompression(vfs.Compression(opts.Compression))}
+	if opts.CopyOnWrite {
+		vfsOpts = append(vfsOpts, vfs.WithCopyOnWrite())
+	}
+	if opts.SparseZeros {
+		vfsOpts = append(vfsOpts, vfs.WithSparseZeros())
+	}
+	journalMode := "DELETE"
+	if opts.WAL {
+		vfsOpts = append(vfsOpts, vfs.WithWAL())
+		journalMode = "WAL"
+	}
+	if opts.ExclusiveProcess {
+		vfsOpts = append(vfsOpts, vfs.WithExclusiveProcess())
+	}
+	keyring, err := vfs.KeySource{File: opts.EncryptionKeyFile, Env: opts.EncryptionKeyEnv, Secret: opts.EncryptionKeySecret, CurrentID: opts.EncryptionKeyID}.Keyring(context.TODO(), clientset, "test")
+	if err != nil {
+		logger.Panic(err)
+	}
+	if keyring != nil {
+		vfsOpts = append(vfsOpts, vfs.WithEncryption(keyring))
+	}
+	vfsN := vfs.NewVFS(clientset, "test", logger, opts.Retries, vfsOpts...)
 
 	// // register the custom kube-sqlite3-vfs vfs with sqlite
 	// // the name specifed here must match the `vfs` param
@@ -99,7 +151,7 @@ func main() {
 	// // file0 is the name of the file stored in kubernetes
 	// // The `vfs=kube-sqlite3-vfs` instructs sqlite to use the custom vfs implementation.
 	// // The name must match the name passed to `sqlite3vfs.RegisterVFS`
-	db, err := sql.Open("sqlite3", "file2.db?_journal=MEMORY&_cache_size=-256&vfs=kube-sqlite3-vfs")
+	db, err := sql.Open("sqlite3", "file2.db?_journal="+journalMode+"&_cache_size=-256&vfs=kube-sqlite3-vfs")
 	if err != nil {
 		logger.Panic(err)
 	}
@@ -0,0 +1,10 @@
+// Package v1alpha1 contains the custom resources used by the CRD storage backend.
+// SQLiteFile holds a file's metadata and SQLiteSector holds one sector of its data.
+//
+// zz_generated.deepcopy.go and the CRDs in config/crd are generated with controller-gen:
+//
+//	controller-gen object crd paths=./pkg/apis/... output:crd:dir=./config/crd
+//
+// +kubebuilder:object:generate=true
+// +groupName=sqlite3vfs.richardoc.github.io
+package v1alpha1
@@ -0,0 +1,75 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SQLiteFile is the metadata of a file stored by the vfs, one per file
+//
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=sqlf
+// +kubebuilder:printcolumn:name="Filename",type=string,JSONPath=`.spec.filename`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.spec.size`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type SQLiteFile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SQLiteFileSpec `json:"spec"`
+}
+
+type SQLiteFileSpec struct {
+	// Filename is the name SQLite knows the file by
+	Filename string `json:"filename"`
+	// Size is the length of the file in bytes
+	Size int64 `json:"size"`
+	// Sectors is how many sectors are needed to hold Size bytes
+	Sectors int64 `json:"sectors"`
+	// Attributes holds the rest of the vfs's metadata, such as the format version
+	// +optional
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// SQLiteFileList is a list of SQLiteFiles
+//
+// +kubebuilder:object:root=true
+type SQLiteFileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []SQLiteFile `json:"items"`
+}
+
+// SQLiteSector is one sector of a file's data
+//
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=sqls
+// +kubebuilder:printcolumn:name="Filename",type=string,JSONPath=`.spec.filename`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type SQLiteSector struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SQLiteSectorSpec `json:"spec"`
+}
+
+type SQLiteSectorSpec struct {
+	// Filename is the name of the file this sector belongs to
+	Filename string `json:"filename"`
+	// Data is the contents of the sector
+	// +optional
+	Data []byte `json:"data,omitempty"`
+	// Attributes holds anything else stored alongside the data
+	// +optional
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// SQLiteSectorList is a list of SQLiteSectors
+//
+// +kubebuilder:object:root=true
+type SQLiteSectorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []SQLiteSector `json:"items"`
+}
@@ -0,0 +1,187 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// DefaultOpTimeout is how long each call to the API server can take, unless WithOpTimeout says otherwise
+const DefaultOpTimeout = 30 * time.Second
+
+// apiStore applies the rate limit, timeout and retry policy to every call to the store
+type apiStore struct {
+	store   SectorStore
+	timeout time.Duration
+	retry   RetryPolicy
+	limit   RateLimit
+	limiter *rate.Limiter
+	logger  *zap.SugaredLogger
+}
+
+// do runs call, retrying it while the API server can't answer
+func (s *apiStore) do(ctx context.Context, op string, call func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := s.take(ctx, op)
+		if err != nil {
+			return err
+		}
+		err = s.attempt(ctx, call)
+		if err == nil || !retriable(err) || attempt >= s.retry.Retries {
+			return err
+		}
+		s.logger.Warnw("API call failed, retrying", "op", op, "attempt", attempt+1, "err", err)
+		if s.retry.wait(ctx, attempt, err) != nil {
+			return err
+		}
+	}
+}
+
+// attempt runs call with its own deadline. Nothing is sent once ctx is done, and running out of time counts as the API being unavailable
+func (s *apiStore) attempt(ctx context.Context, call func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return apiError(err)
+	}
+	var cancel context.CancelFunc
+	if s.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	err := call(ctx)
+	if err != nil && ctx.Err() != nil {
+		return apiError(err)
+	}
+	return err
+}
+
+// put runs a create or update with do. An attempt which timed out could still have been applied,
+// in which case retrying it conflicts with our own write, so a conflict after a retry is only an error if written says what's stored isn't ours.
+func (s *apiStore) put(ctx context.Context, op string, call func(ctx context.Context) error, written func(ctx context.Context) (bool, error)) error {
+	attempts := 0
+	err := s.do(ctx, op, func(ctx context.Context) error {
+		attempts++
+		return call(ctx)
+	})
+	if err != errConflict || attempts == 1 {
+		return err
+	}
+	ours, rerr := written(ctx)
+	if rerr != nil || !ours {
+		return err
+	}
+	s.logger.Debugw("Retried write had already been applied", "op", op)
+	return nil
+}
+
+// sameStrings compares string maps, treating nil and empty as the same
+func sameStrings(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// recordWritten is put's check for lockfiles and metadata, taking the stored ResourceVersion if it's ours
+func recordWritten(get func(ctx context.Context, name string) (*Record, error), r *Record) func(ctx context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		stored, err := get(ctx, r.Name)
+		if err != nil || !sameStrings(stored.Data, r.Data) {
+			return false, err
+		}
+		r.ResourceVersion = stored.ResourceVersion
+		return true, nil
+	}
+}
+
+func (s *apiStore) Ping(ctx context.Context) error {
+	return s.do(ctx, "Ping", s.store.Ping)
+}
+
+func (s *apiStore) GetSector(ctx context.Context, name string) (*SectorRecord, error) {
+	var res *SectorRecord
+	err := s.do(ctx, "GetSector", func(ctx context.Context) (err error) {
+		res, err = s.store.GetSector(ctx, name)
+		return err
+	})
+	return res, err
+}
+
+func (s *apiStore) PutSector(ctx context.Context, sr *SectorRecord) error {
+	return s.put(ctx, "PutSector", func(ctx context.Context) error {
+		return s.store.PutSector(ctx, sr)
+	}, func(ctx context.Context) (bool, error) {
+		stored, err := s.GetSector(ctx, sr.Name)
+		if err != nil || !bytes.Equal(stored.Data, sr.Data) || !sameStrings(stored.Attributes, sr.Attributes) {
+			return false, err
+		}
+		sr.ResourceVersion = stored.ResourceVersion
+		return true, nil
+	})
+}
+
+func (s *apiStore) DeleteSector(ctx context.Context, name string) error {
+	return s.do(ctx, "DeleteSector", func(ctx context.Context) error {
+		return s.store.DeleteSector(ctx, name)
+	})
+}
+
+func (s *apiStore) ListSectors(ctx context.Context, labels map[string]string) ([]*SectorRecord, error) {
+	var res []*SectorRecord
+	err := s.do(ctx, "ListSectors", func(ctx context.Context) (err error) {
+		res, err = s.store.ListSectors(ctx, labels)
+		return err
+	})
+	return res, err
+}
+
+func (s *apiStore) GetLock(ctx context.Context, name string) (*Record, error) {
+	var res *Record
+	err := s.do(ctx, "GetLock", func(ctx context.Context) (err error) {
+		res, err = s.store.GetLock(ctx, name)
+		return err
+	})
+	return res, err
+}
+
+func (s *apiStore) PutLock(ctx context.Context, r *Record) error {
+	return s.put(ctx, "PutLock", func(ctx context.Context) error {
+		return s.store.PutLock(ctx, r)
+	}, recordWritten(s.GetLock, r))
+}
+
+func (s *apiStore) DeleteLock(ctx context.Context, name string) error {
+	return s.do(ctx, "DeleteLock", func(ctx context.Context) error {
+		return s.store.DeleteLock(ctx, name)
+	})
+}
+
+func (s *apiStore) GetMetadata(ctx context.Context, name string) (*Record, error) {
+	var res *Record
+	err := s.do(ctx, "GetMetadata", func(ctx context.Context) (err error) {
+		res, err = s.store.GetMetadata(ctx, name)
+		return err
+	})
+	return res, err
+}
+
+func (s *apiStore) PutMetadata(ctx context.Context, r *Record) error {
+	return s.put(ctx, "PutMetadata", func(ctx context.Context) error {
+		return s.store.PutMetadata(ctx, r)
+	}, recordWritten(s.GetMetadata, r))
+}
+
+func (s *apiStore) DeleteMetadata(ctx context.Context, name string) error {
+	return s.do(ctx, "DeleteMetadata", func(ctx context.Context) error {
+		return s.store.DeleteMetadata(ctx, name)
+	})
+}
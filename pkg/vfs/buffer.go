@@ -0,0 +1,97 @@
+package vfs
+
+import (
+	"sort"
+
+	"github.com/psanford/sqlite3vfs"
+)
+
+// bufferSector keeps a changed sector in memory until the next flush, flushing early if the buffer is full
+func (f *file) bufferSector(s *Sector) error {
+	if f.dirty == nil {
+		f.dirty = map[int64]*Sector{}
+	}
+	f.dirty[s.Index] = s
+	f.vfs.logger.Debugw("bufferSector", "sectorIndex", s.Index, "dirty", len(f.dirty))
+
+	if len(f.dirty) >= f.writeBufferSectors() {
+		return f.flushSectors()
+	}
+	return nil
+}
+
+// bufferedSector returns a copy of our unwritten changes to a sector, if there are any
+func (f *file) bufferedSector(sectorIndex int64) (*Sector, bool) {
+	s, ok := f.dirty[sectorIndex]
+	if !ok {
+		return nil, false
+	}
+	data := make([]byte, len(s.Data))
+	copy(data, s.Data)
+
+	return &Sector{Index: s.Index, Data: data, ResourceVersion: s.ResourceVersion}, true
+}
+
+// flush writes out everything buffered, the sectors first so the new size never covers data which isn't there yet
+func (f *file) flush() error {
+	if !f.buffering {
+		return nil
+	}
+	if err := f.checkLock(); err != nil {
+		return err
+	}
+
+	err := f.flushSectors()
+	if err != nil {
+		return err
+	}
+
+	// In copy-on-write mode the size is already part of the transaction
+	if f.txn == nil && (f.meta == nil || f.bufferedSize != f.meta.Size) {
+		err := f.setSize(f.bufferedSize)
+		if err != nil {
+			return err
+		}
+	}
+	f.buffering = false
+
+	return nil
+}
+
+// flushSectors writes out the buffered sectors in order
+func (f *file) flushSectors() error {
+	indexes := make([]int64, 0, len(f.dirty))
+	for index := range f.dirty {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	f.vfs.logger.Debugw("flushSectors", "name", f.RawName, "sectors", len(indexes))
+	for _, index := range indexes {
+		err := f.putSector(f.dirty[index])
+		if err != nil {
+			return err
+		}
+		delete(f.dirty, index)
+	}
+
+	return nil
+}
+
+// confirmSync checks the API server is giving out what we last wrote, for SyncFull
+func (f *file) confirmSync() error {
+	if f.meta == nil {
+		return nil
+	}
+	r, err := f.vfs.store.GetMetadata(f.vfs.ctx, f.MetadataName())
+	if err != nil {
+		f.vfs.logger.Errorw("Failed to read back metadata after sync", "name", f.RawName, "err", err)
+		return err
+	}
+	if r.ResourceVersion != f.meta.ResourceVersion {
+		f.vfs.logger.Errorw("Metadata changed underneath us during sync", "name", f.RawName, "expected", f.meta.ResourceVersion, "got", r.ResourceVersion)
+		return sqlite3vfs.IOError
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package vfs
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// countWrites counts the creates and updates of configmaps from now on
+func countWrites(kc *fake.Clientset) *atomic.Int64 {
+	var writes atomic.Int64
+	kc.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetVerb() == "create" || action.GetVerb() == "update" {
+			writes.Add(1)
+		}
+		return false, nil, nil
+	})
+	return &writes
+}
+
+func TestWriteBuffer(t *testing.T) {
+	v, kc := newTestVFS(t, WithWriteBuffer(8))
+	reader := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	f := openTestFile(t, v, "buffered.db")
+	g := openTestFile(t, reader, "buffered.db")
+	writes := countWrites(kc)
+
+	// Lots of small writes to the same couple of sectors, like SQLite filling in pages
+	data := randomBytes(t, SectorSize+100)
+	for off := 0; off < len(data); off += 1000 {
+		end := off + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := f.WriteAt(data[off:end], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := writes.Load(); n != 0 {
+		t.Errorf("expected nothing to be written before Sync, got %d writes", n)
+	}
+
+	if got := readAll(t, f); !bytes.Equal(got, data) {
+		t.Error("writer doesn't see its own buffered writes")
+	}
+	if got := readAll(t, g); len(got) != 0 {
+		t.Errorf("reader sees %d bytes before Sync", len(got))
+	}
+
+	if err := f.Sync(sqlite3vfs.SyncNormal); err != nil {
+		t.Fatal(err)
+	}
+	// Both sectors and the size
+	if n := writes.Load(); n != 3 {
+		t.Errorf("expected 3 writes after Sync, got %d", n)
+	}
+	if got := readAll(t, g); !bytes.Equal(got, data) {
+		t.Error("reader doesn't see the synced writes")
+	}
+
+	if err := f.Sync(sqlite3vfs.SyncFull); err != nil {
+		t.Fatal(err)
+	}
+	if n := writes.Load(); n != 3 {
+		t.Errorf("nothing to write but Sync wrote %d times", n-3)
+	}
+}
+
+func TestWriteBufferFull(t *testing.T) {
+	v, kc := newTestVFS(t, WithWriteBuffer(2))
+	reader := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	f := openTestFile(t, v, "full.db")
+	g := openTestFile(t, reader, "full.db")
+
+	data := randomBytes(t, 3*SectorSize)
+	for i := 0; i < 3; i++ {
+		if _, err := f.WriteAt(data[i*SectorSize:(i+1)*SectorSize], int64(i*SectorSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first two sectors were written when the buffer filled up, but the size waits for Sync
+	sect, err := g.getSector(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sect.Data, data[SectorSize:2*SectorSize]) {
+		t.Error("a full buffer wasn't written out")
+	}
+	if size, _ := g.FileSize(); size != 0 {
+		t.Errorf("size changed to %d before Sync", size)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, g); !bytes.Equal(got, data) {
+		t.Error("Close didn't write out the buffer")
+	}
+}
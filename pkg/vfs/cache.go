@@ -0,0 +1,244 @@
+package vfs
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sectorCache keeps recently read sectors and metadata of main database files in memory.
+//
+// It's only trusted while SQLite holds a lock on the file. Nobody can write the database while
+// anyone holds SHARED, so what we cached stays right unless someone else committed since we last
+// looked. Commits are counted in the lockfile, and when taking SHARED shows the count has changed
+// everything cached for that file is dropped.
+// A watch on the sectors also drops anything which changes, so stale copies don't hang around.
+// WAL mode breaks this, as checkpoints write the database while SHARED is held, so there's no cache with WithWAL.
+type sectorCache struct {
+	mu     sync.Mutex
+	max    int
+	logger *zap.SugaredLogger
+	// lru has the most recently used entry at the front
+	lru *list.List
+	// files maps each file to the names of its entries in lru
+	files map[string]map[string]*list.Element
+	// commits is the commit count for each file as of the last time we checked
+	commits map[string]uint64
+}
+
+type cacheEntry struct {
+	file     string
+	name     string
+	sector   *SectorRecord
+	metadata *Record
+}
+
+func newSectorCache(max int, logger *zap.SugaredLogger) *sectorCache {
+	return &sectorCache{
+		max:     max,
+		logger:  logger,
+		lru:     list.New(),
+		files:   map[string]map[string]*list.Element{},
+		commits: map[string]uint64{},
+	}
+}
+
+func (c *sectorCache) get(file, name string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.files[file][name]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *sectorCache) getSector(file, name string) (*SectorRecord, bool) {
+	e := c.get(file, name)
+	if e == nil || e.sector == nil {
+		return nil, false
+	}
+	// The caller is allowed to change what it gets back
+	sr := *e.sector
+	sr.Data = append([]byte(nil), e.sector.Data...)
+	return &sr, true
+}
+
+func (c *sectorCache) getMetadata(file, name string) (*Record, bool) {
+	e := c.get(file, name)
+	if e == nil || e.metadata == nil {
+		return nil, false
+	}
+	r := *e.metadata
+	r.Data = make(map[string]string, len(e.metadata.Data))
+	for k, v := range e.metadata.Data {
+		r.Data[k] = v
+	}
+	return &r, true
+}
+
+func (c *sectorCache) put(e *cacheEntry) {
+	c.putIf(e, func(*cacheEntry) bool { return true })
+}
+
+// putIf only replaces an entry which is already there if replace says so
+func (c *sectorCache) putIf(e *cacheEntry, replace func(old *cacheEntry) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.files[e.file][e.name]; ok {
+		if !replace(el.Value.(*cacheEntry)) {
+			return
+		}
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	if c.files[e.file] == nil {
+		c.files[e.file] = map[string]*list.Element{}
+	}
+	c.files[e.file][e.name] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.max {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *sectorCache) putSector(file string, sr *SectorRecord) {
+	stored := *sr
+	stored.Data = append([]byte(nil), sr.Data...)
+	c.put(&cacheEntry{file: file, name: sr.Name, sector: &stored})
+}
+
+// putFetched caches a sector fetched in the background. A write or another read can have cached
+// a newer version while it was being fetched, which it mustn't replace.
+func (c *sectorCache) putFetched(file string, sr *SectorRecord) {
+	stored := *sr
+	stored.Data = append([]byte(nil), sr.Data...)
+	c.putIf(&cacheEntry{file: file, name: sr.Name, sector: &stored}, func(old *cacheEntry) bool {
+		return old.sector != nil && olderVersion(old.sector.ResourceVersion, sr.ResourceVersion)
+	})
+}
+
+// olderVersion reports whether resourceVersion a comes before b.
+// They're meant to be opaque, but are etcd revisions in practice, anything else isn't assumed to be older.
+func olderVersion(a, b string) bool {
+	x, err := strconv.ParseUint(a, 10, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseUint(b, 10, 64)
+	return err == nil && x < y
+}
+
+func (c *sectorCache) putMetadata(file string, r *Record) {
+	stored := *r
+	stored.Data = make(map[string]string, len(r.Data))
+	for k, v := range r.Data {
+		stored.Data[k] = v
+	}
+	c.put(&cacheEntry{file: file, name: r.Name, metadata: &stored})
+}
+
+func (c *sectorCache) remove(file, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.files[file][name]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removeElement must be called with mu held
+func (c *sectorCache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.files[e.file], e.name)
+	if len(c.files[e.file]) == 0 {
+		delete(c.files, e.file)
+	}
+}
+
+func (c *sectorCache) invalidateFile(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, el := range c.files[file] {
+		c.removeElement(el)
+	}
+}
+
+func (c *sectorCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.files = map[string]map[string]*list.Element{}
+	c.commits = map[string]uint64{}
+}
+
+// sawCommits drops the cache for file if anyone has committed to it since we last checked
+func (c *sectorCache) sawCommits(file string, commits uint64) {
+	c.mu.Lock()
+	seen, ok := c.commits[file]
+	c.commits[file] = commits
+	c.mu.Unlock()
+
+	if !ok || seen != commits {
+		c.logger.Debugw("File has been changed, dropping its cache", "file", file, "commits", commits, "seen", seen)
+		c.invalidateFile(file)
+	}
+}
+
+// committed records one of our own commits, which can't have made anything we cached stale
+func (c *sectorCache) committed(file string, commits uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.commits[file] = commits
+}
+
+// sectorChanged is called by the watch, dropping sectors which aren't the version we have
+func (c *sectorCache) sectorChanged(sr *SectorRecord, deleted bool) {
+	file := sr.Labels["relevant-file"]
+	e := c.get(file, sr.Name)
+	// Metadata is looked after by the commit count, and watches which don't filter by label shouldn't drop it
+	if e == nil || e.sector == nil {
+		return
+	}
+	if deleted || e.sector.ResourceVersion != sr.ResourceVersion {
+		c.remove(file, sr.Name)
+	}
+}
+
+// watch keeps the cache up to date for as long as the vfs exists
+func (c *sectorCache) watch(ctx context.Context, w SectorWatcher) {
+	for ctx.Err() == nil {
+		err := w.WatchSectors(ctx, CommonSectorLabel, c.sectorChanged)
+		if ctx.Err() != nil {
+			return
+		}
+		// We could have missed changes while the watch wasn't running
+		c.clear()
+		c.logger.Debugw("Sector watch ended, restarting it", "err", err)
+		if err != nil {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// fileKey is how sectors and metadata of a file are grouped in the cache, the same as their relevant-file label
+func (f *file) fileKey() string {
+	return f.id
+}
+
+// cached reports whether this file's reads go through the cache.
+// Only the main database is read under locks, journals are left alone.
+func (f *file) cached() bool {
+	return f.vfs.cache != nil && f.mainDB
+}
@@ -0,0 +1,157 @@
+package vfs
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// countGets counts the gets of configmaps from now on
+func countGets(kc *fake.Clientset) *atomic.Int64 {
+	var gets atomic.Int64
+	kc.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets.Add(1)
+		return false, nil, nil
+	})
+	return &gets
+}
+
+// writeLocked writes data like SQLite would, holding an EXCLUSIVE lock
+func writeLocked(t *testing.T, f *file, data []byte) {
+	t.Helper()
+	for _, lock := range []sqlite3vfs.LockType{sqlite3vfs.LockShared, sqlite3vfs.LockReserved, sqlite3vfs.LockExclusive} {
+		if err := f.Lock(lock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLocked reads the whole file holding a SHARED lock
+func readLocked(t *testing.T, f *file) []byte {
+	t.Helper()
+	if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Unlock(sqlite3vfs.LockNone)
+	return readAll(t, f)
+}
+
+func TestReadCache(t *testing.T) {
+	v, kc := newTestVFS(t, WithReadCache(16))
+	writer := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	f := openTestFile(t, v, "cached.db")
+	w := openTestFile(t, writer, "cached.db")
+
+	data := randomBytes(t, 2*SectorSize)
+	writeLocked(t, w, data)
+
+	if got := readLocked(t, f); !bytes.Equal(got, data) {
+		t.Fatal("first read didn't match")
+	}
+
+	gets := countGets(kc)
+	if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	before := gets.Load()
+	if got := readAll(t, f); !bytes.Equal(got, data) {
+		t.Error("cached read didn't match")
+	}
+	if n := gets.Load() - before; n != 0 {
+		t.Errorf("reading again under a lock made %d gets, expected it all to be cached", n)
+	}
+	if err := f.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else commits, the next SHARED lock notices
+	data = randomBytes(t, 2*SectorSize)
+	writeLocked(t, w, data)
+	if got := readLocked(t, f); !bytes.Equal(got, data) {
+		t.Error("read after another writer committed returned stale data")
+	}
+
+	// Our own commits don't throw away the cache.
+	// The metadata is only dropped by the commit count, sectors could also be dropped by the watch
+	writeLocked(t, f, data)
+	if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.cache.getMetadata(f.fileKey(), f.MetadataName()); !ok {
+		t.Error("our own commit dropped the cache")
+	}
+	f.Unlock(sqlite3vfs.LockNone)
+}
+
+func TestReadCacheWatch(t *testing.T) {
+	v, kc := newTestVFS(t, WithReadCache(16))
+	writer := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	f := openTestFile(t, v, "watched.db")
+	w := openTestFile(t, writer, "watched.db")
+
+	writeLocked(t, w, []byte("before"))
+	readLocked(t, f)
+	name := f.sectorNameFromSectorIndex(0)
+	if _, ok := v.cache.getSector(f.fileKey(), name); !ok {
+		t.Fatal("sector wasn't cached")
+	}
+
+	// Keep writing, the watch might not have started yet
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		writeLocked(t, w, randomBytes(t, 10))
+		time.Sleep(10 * time.Millisecond)
+		if _, ok := v.cache.getSector(f.fileKey(), name); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watch never dropped the changed sector")
+		}
+	}
+}
+
+func TestReadCacheEviction(t *testing.T) {
+	v, _ := newTestVFS(t, WithReadCache(2))
+	f := openTestFile(t, v, "evict.db")
+
+	data := randomBytes(t, 4*SectorSize)
+	writeLocked(t, f, data)
+	if got := readLocked(t, f); !bytes.Equal(got, data) {
+		t.Error("read didn't match")
+	}
+	if n := v.cache.lru.Len(); n != 2 {
+		t.Errorf("cache holds %d entries, expected it to stop at 2", n)
+	}
+}
+
+func TestReadCachePutFetched(t *testing.T) {
+	c := newSectorCache(16, zaptest.NewLogger(t).Sugar())
+	sector := func(version, data string) *SectorRecord {
+		return &SectorRecord{Name: "s", ResourceVersion: version, Data: []byte(data)}
+	}
+
+	c.putFetched("f", sector("5", "fetched"))
+	c.putSector("f", sector("7", "written"))
+	// A fetch which started before the write finishes after it
+	c.putFetched("f", sector("5", "fetched"))
+	if sr, _ := c.getSector("f", "s"); string(sr.Data) != "written" {
+		t.Errorf("read-ahead replaced a newer sector with %q", sr.Data)
+	}
+	c.putFetched("f", sector("9", "newer"))
+	if sr, _ := c.getSector("f", "s"); string(sr.Data) != "newer" {
+		t.Errorf("read-ahead didn't replace an older sector, got %q", sr.Data)
+	}
+}
@@ -0,0 +1,74 @@
+package vfs
+
+// removedGeneration marks sectors truncated away during a copy-on-write transaction.
+// Their old versions are kept until the commit, but we mustn't read them in the meantime.
+const removedGeneration = -1
+
+// beginTxn starts collecting copy-on-write changes from the latest committed version of the file
+func (f *file) beginTxn() error {
+	if f.txn != nil {
+		return nil
+	}
+
+	m, err := f.getMetadata()
+	if err != nil {
+		return err
+	}
+	f.txn = m.copy()
+	f.txn.Generation = m.Generation + 1
+	f.vfs.logger.Debugw("beginTxn", "name", f.RawName, "generation", f.txn.Generation)
+
+	return nil
+}
+
+// commit switches the file over to the sectors written since the last commit with a single metadata update,
+// then tidies up the versions which aren't needed any more
+func (f *file) commit() error {
+	if f.txn == nil {
+		return nil
+	}
+	if err := f.checkLock(); err != nil {
+		return err
+	}
+	// Compacting a copy, as the transaction carries on as it was if the commit fails
+	m := f.txn.copy()
+	m.compact()
+
+	err := f.setMetadata(m)
+	if err == errConflict {
+		// Shouldn't happen while we hold the locks SQLite asked for.
+		// Its sectors are left behind, they could have the same names as whatever beat us to it.
+		f.vfs.logger.Errorw("File was changed by someone else during our transaction, abandoning it", "name", f.RawName, "generation", m.Generation)
+		f.txn = nil
+		f.superseded = nil
+		return err
+	} else if err != nil {
+		// Kept so a retried Sync can commit it
+		f.vfs.logger.Errorw("Failed to commit transaction", "name", f.RawName, "generation", m.Generation, "err", err)
+		return err
+	}
+	superseded := f.superseded
+	f.txn = nil
+	f.superseded = nil
+	f.vfs.logger.Debugw("commit", "name", f.RawName, "generation", m.Generation, "size", m.Size)
+
+	// A sector can be replaced more than once in a transaction, don't remove the version we ended up with
+	live := map[string]bool{}
+	for index, generation := range m.Manifest {
+		if generation == m.Generation {
+			live[f.sectorName(index, generation)] = true
+		}
+	}
+	for _, sectorName := range superseded {
+		if live[sectorName] {
+			continue
+		}
+		err := f.deleteSector(sectorName)
+		if err != nil && err != ErrSectorMissing {
+			// Only wastes space, the file no longer refers to it
+			f.vfs.logger.Warnw("Failed to delete old sector version", "sector", sectorName, "err", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func readAll(t *testing.T, f *file) []byte {
+	t.Helper()
+	size, err := f.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, size)
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestCopyOnWriteCommit(t *testing.T) {
+	writer, kc := newTestVFS(t, WithCopyOnWrite())
+	reader := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	f := openTestFile(t, writer, "cow.db")
+	g := openTestFile(t, reader, "cow.db")
+
+	data := randomBytes(t, 3*SectorSize)
+	_, err := f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readAll(t, f); !bytes.Equal(got, data) {
+		t.Error("writer doesn't see its own uncommitted writes")
+	}
+	if got := readAll(t, g); len(got) != 0 {
+		t.Errorf("reader sees %d bytes before the commit", len(got))
+	}
+
+	if err := f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, g); !bytes.Equal(got, data) {
+		t.Error("reader doesn't see the committed writes")
+	}
+	before := countConfigMaps(t, kc)
+
+	// Change two sectors, then change one of them again
+	patch := randomBytes(t, SectorSize)
+	_, err = f.WriteAt(patch, SectorSize/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("again"), SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, g); !bytes.Equal(got, data) {
+		t.Error("reader sees uncommitted writes")
+	}
+
+	if err := f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[SectorSize/2:], patch)
+	copy(data[SectorSize:], "again")
+	if got := readAll(t, g); !bytes.Equal(got, data) {
+		t.Error("reader doesn't see the second commit")
+	}
+
+	// The old versions are tidied up
+	if after := countConfigMaps(t, kc); after != before {
+		t.Errorf("went from %d to %d configmaps after replacing sectors", before, after)
+	}
+}
+
+func TestCopyOnWriteFailedCommit(t *testing.T) {
+	writer, kc := newTestVFS(t, WithCopyOnWrite())
+	reader := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	f := openTestFile(t, writer, "failed.db")
+	g := openTestFile(t, reader, "failed.db")
+
+	data := randomBytes(t, 2*SectorSize)
+	_, err := f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	before := countConfigMaps(t, kc)
+	patch := randomBytes(t, 2*SectorSize-100)
+	_, err = f.WriteAt(patch, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Die as the metadata is being switched over
+	var down atomic.Bool
+	down.Store(true)
+	kc.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		cm := action.(k8stesting.UpdateAction).GetObject().(*v1.ConfigMap)
+		if cm.Name == f.MetadataName() && down.Load() {
+			return true, nil, errors.New("pod has crashed")
+		}
+		return false, nil, nil
+	})
+	if err := f.Sync(0); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+
+	if got := readAll(t, g); !bytes.Equal(got, data) {
+		t.Error("a failed commit changed the file")
+	}
+
+	// The transaction is still there to try again
+	down.Store(false)
+	if err := f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[100:], patch)
+	if got := readAll(t, g); !bytes.Equal(got, data) {
+		t.Error("reader doesn't see the retried commit")
+	}
+	if after := countConfigMaps(t, kc); after != before {
+		t.Errorf("went from %d to %d configmaps after the retried commit", before, after)
+	}
+}
+
+func TestCopyOnWriteTruncate(t *testing.T) {
+	v, _ := newTestVFS(t, WithCopyOnWrite())
+	f := openTestFile(t, v, "truncate.db")
+
+	data := randomBytes(t, 3*SectorSize)
+	_, err := f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrink then grow again, leaving a hole where the old data was
+	err = f.Truncate(SectorSize + 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("end"), 3*SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make([]byte, 3*SectorSize+3)
+	copy(expected, data[:SectorSize+20])
+	copy(expected[3*SectorSize:], "end")
+	if got := readAll(t, f); !bytes.Equal(got, expected) {
+		t.Error("truncated data came back before the commit")
+	}
+
+	if err := f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, f); !bytes.Equal(got, expected) {
+		t.Error("truncated data came back after the commit")
+	}
+}
@@ -0,0 +1,69 @@
+package vfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression is how sector data is compressed before it's stored
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+)
+
+// compressionAttribute records how each sector was compressed, so files with a mix of sectors stay readable.
+// Sectors without it are stored as is.
+const compressionAttribute = "compression"
+
+// compressSector returns data as it should be stored, and the compression used if any
+func compressSector(data []byte, c Compression) ([]byte, Compression, error) {
+	if c != CompressionGzip || len(data) == 0 {
+		return data, CompressionNone, nil
+	}
+
+	var buf bytes.Buffer
+	// Speed matters more than size here, as it's on every write
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	if buf.Len() >= len(data) {
+		return data, CompressionNone, nil
+	}
+
+	return buf.Bytes(), CompressionGzip, nil
+}
+
+// decompressSector reverses compressSector, refusing to produce more than maxSize bytes
+func decompressSector(data []byte, c Compression, maxSize int64) ([]byte, error) {
+	switch c {
+	case "", CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(out)) > maxSize {
+			return nil, fmt.Errorf("decompressed sector is bigger than the sector size %d", maxSize)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown sector compression %q", c)
+	}
+}
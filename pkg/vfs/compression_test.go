@@ -0,0 +1,70 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCompression(t *testing.T) {
+	v, kc := newTestVFS(t, WithCompression(CompressionGzip))
+	f := openTestFile(t, v, "compressed.db")
+
+	// One sector of text followed by one which won't compress
+	data := append(bytes.Repeat([]byte("mostly the same text "), SectorSize/21+1)[:SectorSize], randomBytes(t, SectorSize)...)
+	_, err := f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := v.store.GetSector(context.TODO(), f.sectorNameFromSectorIndex(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text.Attributes[compressionAttribute] != string(CompressionGzip) || len(text.Data) >= SectorSize/10 {
+		t.Errorf("text sector was stored as %d bytes with compression %q", len(text.Data), text.Attributes[compressionAttribute])
+	}
+	random, err := v.store.GetSector(context.TODO(), f.sectorNameFromSectorIndex(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := random.Attributes[compressionAttribute]; ok || !bytes.Equal(random.Data, data[SectorSize:]) {
+		t.Errorf("random sector should be stored as is, got %d bytes with compression %q", len(random.Data), random.Attributes[compressionAttribute])
+	}
+
+	// Something without compression turned on can still read it, and write a mix of sectors
+	other := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	g := openTestFile(t, other, "compressed.db")
+	_, err = g.WriteAt([]byte("uncompressed"), SectorSize+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[SectorSize+10:], "uncompressed")
+
+	for _, reader := range []*file{f, g} {
+		got := make([]byte, len(data))
+		_, err = reader.ReadAt(got, 0)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("ReadAt didn't match what was written")
+		}
+	}
+}
+
+func TestDecompressTooBig(t *testing.T) {
+	compressed, c, err := compressSector(make([]byte, 2*SectorSize), CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompressSector(compressed, c, SectorSize); err == nil {
+		t.Error("expected a sector bigger than the sector size to be rejected")
+	}
+	if _, err := decompressSector(compressed, "lz4", SectorSize); err == nil {
+		t.Error("expected an unknown compression to be rejected")
+	}
+}
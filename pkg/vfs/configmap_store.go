@@ -0,0 +1,214 @@
+package vfs
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// configMapStore keeps sectors, lock files and metadata in ConfigMaps
+type configMapStore struct {
+	kc        kubernetes.Interface
+	namespace string
+	logger    *zap.SugaredLogger
+}
+
+func NewConfigMapStore(kc kubernetes.Interface, namespace string, logger *zap.SugaredLogger) *configMapStore {
+	return &configMapStore{kc: kc, namespace: namespace, logger: logger}
+}
+
+func (s *configMapStore) Ping(ctx context.Context) error {
+	return apiError(serverVersion(ctx, s.kc.Discovery()))
+}
+
+func (s *configMapStore) GetSector(ctx context.Context, name string) (*SectorRecord, error) {
+	cm, err := s.kc.CoreV1().ConfigMaps(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, ErrSectorMissing
+	} else if err != nil {
+		return nil, apiError(err)
+	}
+
+	return sectorRecordFromConfigMap(cm), nil
+}
+
+func (s *configMapStore) PutSector(ctx context.Context, sr *SectorRecord) error {
+	cm := &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sr.Name,
+			Namespace:       s.namespace,
+			Labels:          sr.Labels,
+			ResourceVersion: sr.ResourceVersion,
+		},
+		BinaryData: map[string][]byte{"sector": sr.Data},
+		Data:       sr.Attributes,
+	}
+
+	var (
+		written *v1.ConfigMap
+		err     error
+	)
+	if sr.ResourceVersion == "" {
+		written, err = s.kc.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		written, err = s.kc.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) || kerrors.IsNotFound(err) {
+		s.logger.Debugw("PutSector conflict", "name", sr.Name, "resourceVersion", sr.ResourceVersion, "err", err)
+		return errConflict
+	} else if err != nil {
+		return apiError(err)
+	}
+	sr.ResourceVersion = written.ResourceVersion
+
+	return nil
+}
+
+func (s *configMapStore) DeleteSector(ctx context.Context, name string) error {
+	err := s.kc.CoreV1().ConfigMaps(s.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return ErrSectorMissing
+	}
+
+	return apiError(err)
+}
+
+func (s *configMapStore) ListSectors(ctx context.Context, l map[string]string) ([]*SectorRecord, error) {
+	cms, err := s.kc.CoreV1().ConfigMaps(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(l).String()})
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	sectors := make([]*SectorRecord, 0, len(cms.Items))
+	for i := range cms.Items {
+		sectors = append(sectors, sectorRecordFromConfigMap(&cms.Items[i]))
+	}
+
+	return sectors, nil
+}
+
+func (s *configMapStore) WatchSectors(ctx context.Context, l map[string]string, changed func(sr *SectorRecord, deleted bool)) error {
+	w, err := s.kc.CoreV1().ConfigMaps(s.namespace).Watch(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(l).String()})
+	if err != nil {
+		return apiError(err)
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+			if ev.Type == watch.Error {
+				return kerrors.FromObject(ev.Object)
+			}
+			cm, ok := ev.Object.(*v1.ConfigMap)
+			if !ok {
+				continue
+			}
+			changed(sectorRecordFromConfigMap(cm), ev.Type == watch.Deleted)
+		}
+	}
+}
+
+func (s *configMapStore) GetLock(ctx context.Context, name string) (*Record, error) {
+	return s.getRecord(ctx, name)
+}
+
+func (s *configMapStore) PutLock(ctx context.Context, r *Record) error {
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: r.Name, Labels: r.Labels, ResourceVersion: r.ResourceVersion}, Data: r.Data}
+
+	var err error
+	if r.ResourceVersion == "" {
+		_, err = s.kc.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		_, err = s.kc.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) || kerrors.IsNotFound(err) {
+		return errConflict
+	}
+
+	return apiError(err)
+}
+
+func (s *configMapStore) DeleteLock(ctx context.Context, name string) error {
+	return s.deleteRecord(ctx, name)
+}
+
+func (s *configMapStore) GetMetadata(ctx context.Context, name string) (*Record, error) {
+	return s.getRecord(ctx, name)
+}
+
+func (s *configMapStore) PutMetadata(ctx context.Context, r *Record) error {
+	return s.putRecord(ctx, r)
+}
+
+func (s *configMapStore) DeleteMetadata(ctx context.Context, name string) error {
+	return s.deleteRecord(ctx, name)
+}
+
+func (s *configMapStore) getRecord(ctx context.Context, name string) (*Record, error) {
+	cm, err := s.kc.CoreV1().ConfigMaps(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, apiError(err)
+	}
+
+	return &Record{Name: cm.Name, Labels: cm.Labels, Data: cm.Data, ResourceVersion: cm.ResourceVersion}, nil
+}
+
+func (s *configMapStore) putRecord(ctx context.Context, r *Record) error {
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: r.Name, Labels: r.Labels, ResourceVersion: r.ResourceVersion}, Data: r.Data}
+
+	var (
+		written *v1.ConfigMap
+		err     error
+	)
+	// Without a resourceVersion it's a new file, which mustn't overwrite one someone else just created
+	if r.ResourceVersion == "" {
+		written, err = s.kc.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		written, err = s.kc.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if kerrors.IsConflict(err) || kerrors.IsNotFound(err) || kerrors.IsAlreadyExists(err) {
+		return errConflict
+	} else if err != nil {
+		return apiError(err)
+	}
+	r.ResourceVersion = written.ResourceVersion
+
+	return nil
+}
+
+func (s *configMapStore) deleteRecord(ctx context.Context, name string) error {
+	err := s.kc.CoreV1().ConfigMaps(s.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return errRecordNotFound
+	}
+
+	return apiError(err)
+}
+
+func sectorRecordFromConfigMap(cm *v1.ConfigMap) *SectorRecord {
+	return &SectorRecord{
+		Name:            cm.Name,
+		Labels:          cm.Labels,
+		Data:            cm.BinaryData["sector"],
+		Attributes:      cm.Data,
+		ResourceVersion: cm.ResourceVersion,
+	}
+}
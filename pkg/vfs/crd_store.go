@@ -0,0 +1,306 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/RichardoC/kube-sqlite3-vfs/pkg/apis/sqlite3vfs/v1alpha1"
+	"go.uber.org/zap"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// crdStore keeps metadata in SQLiteFiles and sectors in SQLiteSectors, see config/crd.
+// Lockfiles are still ConfigMaps, they're updated too often to share an object with the metadata.
+type crdStore struct {
+	dc        dynamic.Interface
+	kc        kubernetes.Interface
+	namespace string
+	logger    *zap.SugaredLogger
+	locks     *configMapStore
+}
+
+func NewCRDStore(dc dynamic.Interface, kc kubernetes.Interface, namespace string, logger *zap.SugaredLogger) *crdStore {
+	return &crdStore{dc: dc, kc: kc, namespace: namespace, logger: logger, locks: NewConfigMapStore(kc, namespace, logger)}
+}
+
+// Ping also checks the CRDs have been installed
+func (s *crdStore) Ping(ctx context.Context) error {
+	resources, err := serverResources(ctx, s.kc.Discovery(), v1alpha1.SchemeGroupVersion.String())
+	if err != nil {
+		return apiError(fmt.Errorf("failed to find %s, are the CRDs installed? %w", v1alpha1.SchemeGroupVersion, err))
+	}
+	found := map[string]bool{}
+	for _, r := range resources.APIResources {
+		found[r.Name] = true
+	}
+	for _, gvr := range []string{v1alpha1.SQLiteFileResource.Resource, v1alpha1.SQLiteSectorResource.Resource} {
+		if !found[gvr] {
+			return fmt.Errorf("%s.%s isn't installed", gvr, v1alpha1.GroupName)
+		}
+	}
+
+	return nil
+}
+
+func (s *crdStore) sectors() dynamic.ResourceInterface {
+	return s.dc.Resource(v1alpha1.SQLiteSectorResource).Namespace(s.namespace)
+}
+
+func (s *crdStore) files() dynamic.ResourceInterface {
+	return s.dc.Resource(v1alpha1.SQLiteFileResource).Namespace(s.namespace)
+}
+
+func (s *crdStore) GetSector(ctx context.Context, name string) (*SectorRecord, error) {
+	u, err := s.sectors().Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, ErrSectorMissing
+	} else if err != nil {
+		return nil, apiError(err)
+	}
+
+	return sectorRecordFromUnstructured(u)
+}
+
+func (s *crdStore) PutSector(ctx context.Context, sr *SectorRecord) error {
+	sector := &v1alpha1.SQLiteSector{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "SQLiteSector",
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sr.Name,
+			Namespace:       s.namespace,
+			Labels:          sr.Labels,
+			ResourceVersion: sr.ResourceVersion,
+		},
+		Spec: v1alpha1.SQLiteSectorSpec{Data: sr.Data},
+	}
+	sector.Spec.Filename, sector.Spec.Attributes = splitFilename(sr.Attributes)
+	u, err := toUnstructured(sector)
+	if err != nil {
+		return err
+	}
+
+	var written *unstructured.Unstructured
+	if sr.ResourceVersion == "" {
+		written, err = s.sectors().Create(ctx, u, metav1.CreateOptions{})
+	} else {
+		written, err = s.sectors().Update(ctx, u, metav1.UpdateOptions{})
+	}
+	if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) || kerrors.IsNotFound(err) {
+		s.logger.Debugw("PutSector conflict", "name", sr.Name, "resourceVersion", sr.ResourceVersion, "err", err)
+		return errConflict
+	} else if err != nil {
+		return apiError(err)
+	}
+	sr.ResourceVersion = written.GetResourceVersion()
+
+	return nil
+}
+
+func (s *crdStore) DeleteSector(ctx context.Context, name string) error {
+	err := s.sectors().Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return ErrSectorMissing
+	}
+
+	return apiError(err)
+}
+
+func (s *crdStore) ListSectors(ctx context.Context, l map[string]string) ([]*SectorRecord, error) {
+	list, err := s.sectors().List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(l).String()})
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	sectors := make([]*SectorRecord, 0, len(list.Items))
+	for i := range list.Items {
+		sr, err := sectorRecordFromUnstructured(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		sectors = append(sectors, sr)
+	}
+
+	return sectors, nil
+}
+
+func (s *crdStore) WatchSectors(ctx context.Context, l map[string]string, changed func(sr *SectorRecord, deleted bool)) error {
+	w, err := s.sectors().Watch(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(l).String()})
+	if err != nil {
+		return apiError(err)
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+			if ev.Type == watch.Error {
+				return kerrors.FromObject(ev.Object)
+			}
+			u, ok := ev.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			sr, err := sectorRecordFromUnstructured(u)
+			if err != nil {
+				s.logger.Errorw("Watch got an invalid sector", "name", u.GetName(), "err", err)
+				continue
+			}
+			changed(sr, ev.Type == watch.Deleted)
+		}
+	}
+}
+
+func (s *crdStore) GetLock(ctx context.Context, name string) (*Record, error) {
+	return s.locks.GetLock(ctx, name)
+}
+
+func (s *crdStore) PutLock(ctx context.Context, r *Record) error {
+	return s.locks.PutLock(ctx, r)
+}
+
+func (s *crdStore) DeleteLock(ctx context.Context, name string) error {
+	return s.locks.DeleteLock(ctx, name)
+}
+
+func (s *crdStore) GetMetadata(ctx context.Context, name string) (*Record, error) {
+	u, err := s.files().Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, apiError(err)
+	}
+
+	return recordFromUnstructured(u)
+}
+
+func (s *crdStore) PutMetadata(ctx context.Context, r *Record) error {
+	file := &v1alpha1.SQLiteFile{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "SQLiteFile",
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            r.Name,
+			Namespace:       s.namespace,
+			Labels:          r.Labels,
+			ResourceVersion: r.ResourceVersion,
+		},
+	}
+	var (
+		attributes map[string]string
+		err        error
+	)
+	file.Spec.Filename, attributes = splitFilename(r.Data)
+	file.Spec.Size, err = strconv.ParseInt(attributes["size"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size for %s: %w", r.Name, err)
+	}
+	file.Spec.Sectors, err = strconv.ParseInt(attributes["sectors"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sector count for %s: %w", r.Name, err)
+	}
+	delete(attributes, "size")
+	delete(attributes, "sectors")
+	file.Spec.Attributes = attributes
+	u, err := toUnstructured(file)
+	if err != nil {
+		return err
+	}
+
+	var written *unstructured.Unstructured
+	// Without a resourceVersion it's a new file, which mustn't overwrite one someone else just created
+	if r.ResourceVersion == "" {
+		written, err = s.files().Create(ctx, u, metav1.CreateOptions{})
+	} else {
+		written, err = s.files().Update(ctx, u, metav1.UpdateOptions{})
+	}
+	if kerrors.IsConflict(err) || kerrors.IsNotFound(err) || kerrors.IsAlreadyExists(err) {
+		return errConflict
+	} else if err != nil {
+		return apiError(err)
+	}
+	r.ResourceVersion = written.GetResourceVersion()
+
+	return nil
+}
+
+func (s *crdStore) DeleteMetadata(ctx context.Context, name string) error {
+	err := s.files().Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return errRecordNotFound
+	}
+
+	return apiError(err)
+}
+
+// splitFilename pulls the filename out of the attributes, as it has its own field in the CRDs
+func splitFilename(attributes map[string]string) (string, map[string]string) {
+	rest := make(map[string]string, len(attributes))
+	for k, v := range attributes {
+		rest[k] = v
+	}
+	filename := rest["filename"]
+	delete(rest, "filename")
+	return filename, rest
+}
+
+func toUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: u}, nil
+}
+
+func sectorRecordFromUnstructured(u *unstructured.Unstructured) (*SectorRecord, error) {
+	sector := &v1alpha1.SQLiteSector{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, sector)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+
+	attributes := map[string]string{"filename": sector.Spec.Filename}
+	for k, v := range sector.Spec.Attributes {
+		attributes[k] = v
+	}
+	return &SectorRecord{
+		Name:            sector.Name,
+		Labels:          sector.Labels,
+		Data:            sector.Spec.Data,
+		Attributes:      attributes,
+		ResourceVersion: sector.ResourceVersion,
+	}, nil
+}
+
+func recordFromUnstructured(u *unstructured.Unstructured) (*Record, error) {
+	file := &v1alpha1.SQLiteFile{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, file)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+
+	data := map[string]string{
+		"filename": file.Spec.Filename,
+		"size":     strconv.FormatInt(file.Spec.Size, 10),
+		"sectors":  strconv.FormatInt(file.Spec.Sectors, 10),
+	}
+	for k, v := range file.Spec.Attributes {
+		data[k] = v
+	}
+	return &Record{Name: file.Name, Labels: file.Labels, Data: data, ResourceVersion: file.ResourceVersion}, nil
+}
@@ -0,0 +1,85 @@
+package vfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RichardoC/kube-sqlite3-vfs/pkg/apis/sqlite3vfs/v1alpha1"
+	"go.uber.org/zap/zaptest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestCRDStore(t *testing.T) (*crdStore, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	// Without the typed objects in the scheme so the fake keeps everything unstructured, like the real client
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		v1alpha1.SQLiteFileResource:   "SQLiteFileList",
+		v1alpha1.SQLiteSectorResource: "SQLiteSectorList",
+	})
+	trackResourceVersionsOf(dc, v1alpha1.SQLiteFileResource.Resource, v1alpha1.SQLiteSectorResource.Resource)
+	kc := fake.NewSimpleClientset()
+	trackResourceVersions(kc)
+
+	return NewCRDStore(dc, kc, testNamespace, zaptest.NewLogger(t).Sugar()), kc, dc
+}
+
+func TestCRDStore(t *testing.T) {
+	store, kc, dc := newTestCRDStore(t)
+	if err := store.Ping(context.TODO()); err == nil {
+		t.Error("expected Ping to fail without the CRDs installed")
+	}
+	kc.Resources = []*metav1.APIResourceList{{
+		GroupVersion: v1alpha1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{{Name: "sqlitefiles"}, {Name: "sqlitesectors"}},
+	}}
+
+	v := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, WithSectorStore(store))
+	db := openTestDB(t, v, "crd.db", "_journal=DELETE")
+	defer db.Close()
+	_, err := db.Exec("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertRows(db, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if got := countRows(t, db); got != 100 {
+		t.Errorf("got %d rows, expected 100", got)
+	}
+
+	// Only the lockfiles are left in configmaps
+	cms, err := kc.CoreV1().ConfigMaps(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cm := range cms.Items {
+		if cm.Labels["data"] != "lockfile" {
+			t.Errorf("found configmap %s which isn't a lockfile", cm.Name)
+		}
+	}
+
+	f := NewFile("crd.db", v)
+	u, err := dc.Resource(v1alpha1.SQLiteFileResource).Namespace(testNamespace).Get(context.TODO(), f.MetadataName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &v1alpha1.SQLiteFile{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Spec.Filename != "crd.db" || file.Spec.Size == 0 || file.Spec.Attributes["version"] == "" {
+		t.Errorf("unexpected SQLiteFile spec %+v", file.Spec)
+	}
+
+	sectors, err := dc.Resource(v1alpha1.SQLiteSectorResource).Namespace(testNamespace).List(context.TODO(), metav1.ListOptions{LabelSelector: "relevant-file=" + f.fileKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(sectors.Items)) != file.Spec.Sectors {
+		t.Errorf("found %d SQLiteSectors, expected %d", len(sectors.Items), file.Spec.Sectors)
+	}
+}
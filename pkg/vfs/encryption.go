@@ -0,0 +1,185 @@
+package vfs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// encryptionAttribute and keyIDAttribute record how each sector was encrypted, so keys can be rotated
+	encryptionAttribute = "encryption"
+	keyIDAttribute      = "keyId"
+	encryptionAESGCM    = "aes-256-gcm"
+	// KeySize is the length of encryption keys, for AES-256
+	KeySize = 32
+)
+
+var errNotEncrypted = errors.New("sector isn't encrypted")
+
+// Keyring holds the keys sectors are encrypted with.
+// New sectors use the current key, the others are only kept to read sectors written before a rotation.
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring makes a keyring from keys by ID, which must include current
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current encryption key %q not found", current)
+	}
+	k := &Keyring{current: current, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("encryption key %q is %d bytes, expected %d", id, len(key), KeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// sectorAAD ties a sector's ciphertext to where it belongs, so it can't be moved to another file or index,
+// and to the attributes needed to read it, so they can't be changed either
+func sectorAAD(filename string, index int64, compression, keyID string) []byte {
+	return []byte(filename + "\x00" + strconv.FormatInt(index, 10) + "\x00" + compression + "\x00" + keyID)
+}
+
+// encrypt seals data with the current key and a random nonce, which is stored in front of the ciphertext
+func (k *Keyring) encrypt(data, aad []byte) ([]byte, string, error) {
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, data, aad), k.current, nil
+}
+
+func (k *Keyring) decrypt(data, aad []byte, keyID string) ([]byte, error) {
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("don't have encryption key %q", keyID)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted sector is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// parseKey accepts either the raw key or its base64 encoding, which is easier to keep in files and variables
+func parseKey(b []byte) ([]byte, error) {
+	if len(b) == KeySize {
+		return b, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key isn't %d bytes or base64: %w", KeySize, err)
+	}
+	return key, nil
+}
+
+// KeyFromFile reads a key from a file, such as a mounted Secret
+func KeyFromFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKey(b)
+}
+
+// KeyFromEnv reads a key from an environment variable
+func KeyFromEnv(name string) ([]byte, error) {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s isn't set", name)
+	}
+	return parseKey([]byte(s))
+}
+
+// KeysFromSecret reads every key in a Secret, using the data keys as their IDs.
+// Reading it is retried like the vfs's own calls, using the retry policy, timeout and rate limit from opts.
+func KeysFromSecret(ctx context.Context, kc kubernetes.Interface, namespace, name string, opts ...Option) (map[string][]byte, error) {
+	v := &vfs{retry: DefaultRetryPolicy, opTimeout: DefaultOpTimeout}
+	for _, opt := range opts {
+		opt(v)
+	}
+	api := &apiStore{timeout: v.opTimeout, retry: v.retry, limit: v.rateLimit, limiter: v.rateLimit.limiter(), logger: zap.NewNop().Sugar()}
+
+	var secret *v1.Secret
+	err := api.do(ctx, "GetKeys", func(ctx context.Context) error {
+		var err error
+		secret, err = kc.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		return apiError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(secret.Data))
+	for id, b := range secret.Data {
+		keys[id], err = parseKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("key %q in secret %s: %w", id, name, err)
+		}
+	}
+	return keys, nil
+}
+
+// KeySource is where to find encryption keys, as given to the command line tools.
+// File and Env hold the key called CurrentID, and Secret can hold any number of keys by ID.
+type KeySource struct {
+	File      string
+	Env       string
+	Secret    string
+	CurrentID string
+}
+
+// Keyring loads the keys, returning nil if none were asked for. opts are passed on to KeysFromSecret.
+func (s KeySource) Keyring(ctx context.Context, kc kubernetes.Interface, namespace string, opts ...Option) (*Keyring, error) {
+	if s.File == "" && s.Env == "" && s.Secret == "" {
+		return nil, nil
+	}
+	keys := map[string][]byte{}
+	if s.Secret != "" {
+		secretKeys, err := KeysFromSecret(ctx, kc, namespace, s.Secret, opts...)
+		if err != nil {
+			return nil, err
+		}
+		for id, key := range secretKeys {
+			keys[id] = key
+		}
+	}
+	if s.File != "" {
+		key, err := KeyFromFile(s.File)
+		if err != nil {
+			return nil, err
+		}
+		keys[s.CurrentID] = key
+	}
+	if s.Env != "" {
+		key, err := KeyFromEnv(s.Env)
+		if err != nil {
+			return nil, err
+		}
+		keys[s.CurrentID] = key
+	}
+	return NewKeyring(s.CurrentID, keys)
+}
@@ -0,0 +1,243 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestKeyring(t *testing.T, current string, keys map[string][]byte) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(current, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestEncryption(t *testing.T) {
+	oldKey, newKey := randomBytes(t, KeySize), randomBytes(t, KeySize)
+	v, kc := newTestVFS(t, WithEncryption(newTestKeyring(t, "old", map[string][]byte{"old": oldKey})), WithCompression(CompressionGzip))
+	f := openTestFile(t, v, "secret.db")
+
+	data := bytes.Repeat([]byte("top secret "), 2*SectorSize/11)
+	_, err := f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := v.store.GetSector(context.TODO(), f.sectorNameFromSectorIndex(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sr.Data, []byte("top secret")) {
+		t.Error("sector was stored in plain text")
+	}
+	if sr.Attributes[encryptionAttribute] != encryptionAESGCM || sr.Attributes[keyIDAttribute] != "old" || sr.Attributes[compressionAttribute] != string(CompressionGzip) {
+		t.Errorf("unexpected sector attributes %v", sr.Attributes)
+	}
+
+	// Rotate the key, the old sectors can still be read and new writes use the new key
+	rotated := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, WithEncryption(newTestKeyring(t, "new", map[string][]byte{"old": oldKey, "new": newKey})))
+	g := openTestFile(t, rotated, "secret.db")
+	_, err = g.WriteAt([]byte("rotated"), SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[SectorSize:], "rotated")
+	got := make([]byte, len(data))
+	_, err = g.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAt after rotating the key didn't match")
+	}
+	sr, err = v.store.GetSector(context.TODO(), f.sectorNameFromSectorIndex(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Attributes[keyIDAttribute] != "new" {
+		t.Errorf("rewritten sector used key %q", sr.Attributes[keyIDAttribute])
+	}
+
+	// Without the right keys nothing can be read
+	for name, opts := range map[string][]Option{
+		"no keys":      nil,
+		"only new key": {WithEncryption(newTestKeyring(t, "new", map[string][]byte{"new": newKey}))},
+		"wrong key":    {WithEncryption(newTestKeyring(t, "old", map[string][]byte{"old": newKey}))},
+	} {
+		h := openTestFile(t, NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, opts...), "secret.db")
+		if _, err := h.ReadAt(make([]byte, 10), 0); err == nil {
+			t.Errorf("read encrypted data with %s", name)
+		}
+	}
+}
+
+func TestEncryptedSectorsCantMove(t *testing.T) {
+	keys := WithEncryption(newTestKeyring(t, "key", map[string][]byte{"key": randomBytes(t, KeySize)}))
+	v, kc := newTestVFS(t, keys)
+	f := openTestFile(t, v, "a.db")
+	other := openTestFile(t, v, "b.db")
+	_, err := f.WriteAt(randomBytes(t, 2*SectorSize), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.WriteAt([]byte("plain"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sector 0's data copied over sector 1, and over the other file's sector 0
+	sr, err := v.store.GetSector(context.TODO(), f.sectorNameFromSectorIndex(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []struct {
+		f     *file
+		index int64
+	}{{f, 1}, {other, 0}} {
+		existing, err := v.store.GetSector(context.TODO(), target.f.sectorNameFromSectorIndex(target.index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing.Data = sr.Data
+		existing.Attributes = sr.Attributes
+		if err := v.store.PutSector(context.TODO(), existing); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := target.f.ReadAt(make([]byte, 10), target.index*SectorSize); err == nil {
+			t.Errorf("read sector moved to %s index %d", target.f.RawName, target.index)
+		}
+	}
+
+	// Writing needs the key too, as the rest of the sector has to be read first
+	p := openTestFile(t, NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2), "b.db")
+	if _, err := p.WriteAt([]byte("plain"), 0); err == nil {
+		t.Error("expected writing to an encrypted file without the key to fail")
+	}
+}
+
+func TestEncryptedAttributesCantChange(t *testing.T) {
+	keys := WithEncryption(newTestKeyring(t, "key", map[string][]byte{"key": randomBytes(t, KeySize)}))
+	v, _ := newTestVFS(t, keys, WithCompression(CompressionGzip))
+	f := openTestFile(t, v, "attributes.db")
+	// The first sector compresses and the second doesn't
+	data := append(bytes.Repeat([]byte("a"), SectorSize), randomBytes(t, SectorSize)...)
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for index, compression := range []string{"", string(CompressionGzip)} {
+		sr, err := v.store.GetSector(context.TODO(), f.sectorNameFromSectorIndex(int64(index)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression == "" {
+			delete(sr.Attributes, compressionAttribute)
+		} else {
+			sr.Attributes[compressionAttribute] = compression
+		}
+		if err := v.store.PutSector(context.TODO(), sr); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.getSector(int64(index)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("getSector of sector %d with compression %q returned %v, expected %v", index, compression, err, ErrCorrupt)
+		}
+		if _, err := f.readAt(make([]byte, 10), int64(index)*SectorSize); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("readAt of sector %d with compression %q returned %v, expected %v", index, compression, err, ErrCorrupt)
+		}
+		if _, err := f.ReadAt(make([]byte, 10), int64(index)*SectorSize); err != sqlite3vfs.IOErrorRead {
+			t.Errorf("ReadAt of sector %d with compression %q returned %v, expected %v", index, compression, err, sqlite3vfs.IOErrorRead)
+		}
+	}
+}
+
+func TestKeySource(t *testing.T) {
+	fileKey, envKey, secretKey := randomBytes(t, KeySize), randomBytes(t, KeySize), randomBytes(t, KeySize)
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(fileKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SECTOR_KEY", base64.StdEncoding.EncodeToString(envKey))
+	kc := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "keys", Namespace: testNamespace},
+		Data:       map[string][]byte{"2023": secretKey},
+	})
+
+	for _, tc := range []struct {
+		source  KeySource
+		want    []byte
+		wantErr bool
+	}{
+		{source: KeySource{}},
+		{source: KeySource{File: path, CurrentID: "file"}, want: fileKey},
+		{source: KeySource{Env: "TEST_SECTOR_KEY", CurrentID: "env"}, want: envKey},
+		{source: KeySource{Secret: "keys", CurrentID: "2023"}, want: secretKey},
+		{source: KeySource{Secret: "keys", CurrentID: "2024"}, wantErr: true},
+		{source: KeySource{Env: "TEST_MISSING_KEY", CurrentID: "env"}, wantErr: true},
+	} {
+		k, err := tc.source.Keyring(context.TODO(), kc, testNamespace)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tc.source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.source, err)
+		}
+		if tc.want == nil {
+			if k != nil {
+				t.Errorf("%+v: expected no keyring", tc.source)
+			}
+			continue
+		}
+		// Whatever the expected key encrypts, the keyring can decrypt
+		expected := newTestKeyring(t, tc.source.CurrentID, map[string][]byte{tc.source.CurrentID: tc.want})
+		sealed, id, err := expected.encrypt([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := k.decrypt(sealed, nil, id); err != nil {
+			t.Errorf("%+v: loaded the wrong key: %v", tc.source, err)
+		}
+	}
+}
+
+func TestKeysFromSecretRetries(t *testing.T) {
+	kc := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "keys", Namespace: testNamespace},
+		Data:       map[string][]byte{"2023": randomBytes(t, KeySize)},
+	})
+	policy := RetryPolicy{Retries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	calls := failFirst(kc, "get", "secrets", 2, kerrors.NewServiceUnavailable("down"))
+	keys, err := KeysFromSecret(context.TODO(), kc, testNamespace, "keys", WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatalf("KeysFromSecret returned %v after %d calls", err, *calls)
+	}
+	if len(keys) != 1 {
+		t.Errorf("got %d keys, expected 1", len(keys))
+	}
+
+	policy.Retries = 0
+	failFirst(kc, "get", "secrets", 1, kerrors.NewServiceUnavailable("down"))
+	if _, err := KeysFromSecret(context.TODO(), kc, testNamespace, "keys", WithRetryPolicy(policy)); !errors.Is(err, ErrAPIUnavailable) {
+		t.Errorf("KeysFromSecret returned %v without retries, expected %v", err, ErrAPIUnavailable)
+	}
+}
@@ -0,0 +1,115 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"reflect"
+
+	"github.com/psanford/sqlite3vfs"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Errors callers can match with errors.Is.
+// SQLite only understands its own error codes, so the vfs methods it calls return the matching
+// sqlite3vfs error instead, see sqliteError.
+var (
+	// ErrLockConflict means someone else holds a lock we need
+	ErrLockConflict = errors.New("lock is held by someone else")
+	// ErrSectorMissing is returned by SectorStore.GetSector and DeleteSector when there's no such sector
+	ErrSectorMissing = errors.New("sector not found")
+	// ErrAPIUnavailable means the API server couldn't be reached, or couldn't answer in time
+	ErrAPIUnavailable = errors.New("kubernetes API unavailable")
+	// ErrCorrupt means stored data isn't what was written, or can't be understood
+	ErrCorrupt = errors.New("data is corrupt")
+	// ErrBudgetExceeded means a call wasn't made as it would go over the rate limit, see RateLimit.FailFast
+	ErrBudgetExceeded = errors.New("API call budget exceeded")
+	// ErrLockLost means our locks could have expired before they were renewed, so someone else may have taken them
+	ErrLockLost = errors.New("lock expired before it was renewed")
+	// ErrLeaseLost means we no longer hold the Lease on a database in exclusive process mode, see WithExclusiveProcess
+	ErrLeaseLost = errors.New("lease on the database was lost")
+)
+
+// unavailableError keeps the original error, so it can still be inspected
+type unavailableError struct {
+	err error
+}
+
+func (e unavailableError) Error() string {
+	return ErrAPIUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e unavailableError) Unwrap() error {
+	return e.err
+}
+
+func (e unavailableError) Is(target error) bool {
+	return target == ErrAPIUnavailable
+}
+
+// apiError marks errors from the API server which mean it couldn't answer, rather than that it refused the request.
+// Anything without a status never got an answer at all.
+func apiError(err error) error {
+	if err == nil || errors.Is(err, ErrAPIUnavailable) {
+		return err
+	}
+	var status kerrors.APIStatus
+	if !errors.As(err, &status) || kerrors.IsServerTimeout(err) || kerrors.IsTimeout(err) || kerrors.IsTooManyRequests(err) ||
+		kerrors.IsServiceUnavailable(err) || kerrors.IsInternalError(err) || kerrors.IsUnexpectedServerError(err) {
+		return unavailableError{err: err}
+	}
+	return err
+}
+
+// corrupt marks err as being caused by bad stored data
+func corrupt(err error) error {
+	return corruptError{err: err}
+}
+
+type corruptError struct {
+	err error
+}
+
+func (e corruptError) Error() string {
+	return ErrCorrupt.Error() + ": " + e.err.Error()
+}
+
+func (e corruptError) Unwrap() error {
+	return e.err
+}
+
+func (e corruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// readError marks err as coming from a read, which SQLite is told about even when it happened during a write
+type readError struct {
+	err error
+}
+
+func (e readError) Error() string {
+	return e.err.Error()
+}
+
+func (e readError) Unwrap() error {
+	return e.err
+}
+
+var sqliteErrorType = reflect.TypeOf(sqlite3vfs.IOError)
+
+// sqliteError turns err into one SQLite understands, as the binding only passes on its own errors.
+// fallback is used for anything more specific errors don't cover, such as IOErrorWrite from WriteAt.
+func sqliteError(err error, fallback error) error {
+	switch {
+	case err == nil, err == io.EOF, reflect.TypeOf(err) == sqliteErrorType:
+		return err
+	case errors.Is(err, ErrLockConflict):
+		return sqlite3vfs.BusyError
+	case errors.Is(err, ErrCorrupt), errors.As(err, &readError{}):
+		return sqlite3vfs.IOErrorRead
+	case err == errConflict:
+		// Someone else changed what we were writing
+		return sqlite3vfs.IOErrorWrite
+	default:
+		return fallback
+	}
+}
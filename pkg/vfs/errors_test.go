@@ -0,0 +1,110 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/psanford/sqlite3vfs"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSQLiteError(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		fallback error
+		want     error
+	}{
+		{nil, sqlite3vfs.IOError, nil},
+		{io.EOF, sqlite3vfs.IOErrorRead, io.EOF},
+		{sqlite3vfs.IOErrorShortRead, sqlite3vfs.IOErrorRead, sqlite3vfs.IOErrorShortRead},
+		{ErrLockConflict, sqlite3vfs.IOError, sqlite3vfs.BusyError},
+		{corrupt(errBadChecksum), sqlite3vfs.IOErrorWrite, sqlite3vfs.IOErrorRead},
+		{apiError(errors.New("connection refused")), sqlite3vfs.IOErrorWrite, sqlite3vfs.IOErrorWrite},
+		{errConflict, sqlite3vfs.IOErrorWrite, sqlite3vfs.IOErrorWrite},
+		{errConflict, sqlite3vfs.IOError, sqlite3vfs.IOErrorWrite},
+		{readError{err: apiError(errors.New("connection refused"))}, sqlite3vfs.IOErrorWrite, sqlite3vfs.IOErrorRead},
+	} {
+		if got := sqliteError(tc.err, tc.fallback); got != tc.want {
+			t.Errorf("sqliteError(%v, %v) = %v, expected %v", tc.err, tc.fallback, got, tc.want)
+		}
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	gr := schema.GroupResource{Resource: "configmaps"}
+	for _, tc := range []struct {
+		err         error
+		unavailable bool
+	}{
+		{errors.New("connection refused"), true},
+		{kerrors.NewServiceUnavailable("down"), true},
+		{kerrors.NewTooManyRequests("slow down", 1), true},
+		{kerrors.NewInternalError(errors.New("etcd")), true},
+		{kerrors.NewTimeoutError("slow", 1), true},
+		{kerrors.NewForbidden(gr, "x", errors.New("rbac")), false},
+		{kerrors.NewNotFound(gr, "x"), false},
+	} {
+		err := apiError(tc.err)
+		if errors.Is(err, ErrAPIUnavailable) != tc.unavailable {
+			t.Errorf("apiError(%v) unavailable = %v, expected %v", tc.err, !tc.unavailable, tc.unavailable)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("apiError(%v) lost the original error", tc.err)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	v, kc := newTestVFS(t)
+	f := openTestFile(t, v, "errors.db")
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid requests are errors, not panics
+	if err := f.Unlock(sqlite3vfs.LockExclusive); err == nil {
+		t.Error("expected unlocking to EXCLUSIVE to fail")
+	}
+
+	// Someone else is writing
+	other := openTestFile(t, NewVFS(kc, testNamespace, v.logger, 2, WithContext(v.ctx)), "errors.db")
+	for _, lock := range []sqlite3vfs.LockType{sqlite3vfs.LockShared, sqlite3vfs.LockReserved} {
+		if err := other.Lock(lock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.lock(sqlite3vfs.LockReserved); !errors.Is(err, ErrLockConflict) {
+		t.Errorf("lock returned %v, expected %v", err, ErrLockConflict)
+	}
+	if err := f.Lock(sqlite3vfs.LockReserved); err != sqlite3vfs.BusyError {
+		t.Errorf("Lock returned %v, expected %v", err, sqlite3vfs.BusyError)
+	}
+
+	// The API server goes away
+	kc.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kerrors.NewServiceUnavailable("down")
+	})
+	if _, err := f.getSector(0); !errors.Is(err, ErrAPIUnavailable) {
+		t.Errorf("getSector returned %v, expected %v", err, ErrAPIUnavailable)
+	}
+	// Only the methods SQLite calls turn errors into its own
+	if _, err := f.readAt(make([]byte, 4), 0); !errors.Is(err, ErrAPIUnavailable) {
+		t.Errorf("readAt returned %v, expected %v", err, ErrAPIUnavailable)
+	}
+	if _, err := f.writeAt([]byte("more"), 0); !errors.Is(err, ErrAPIUnavailable) {
+		t.Errorf("writeAt returned %v, expected %v", err, ErrAPIUnavailable)
+	}
+	if err := v.delete("errors.db", false); !errors.Is(err, ErrAPIUnavailable) {
+		t.Errorf("delete returned %v, expected %v", err, ErrAPIUnavailable)
+	}
+	if _, err := f.ReadAt(make([]byte, 4), 0); err != sqlite3vfs.IOErrorRead {
+		t.Errorf("ReadAt returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+	}
+}
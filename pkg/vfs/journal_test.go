@@ -0,0 +1,295 @@
+package vfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// openTestDB registers v with SQLite under a unique name and opens name with it
+func openTestDB(t *testing.T, v *vfs, name string, params string) *sql.DB {
+	t.Helper()
+	vfsName := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	err := sqlite3vfs.RegisterVFS(vfsName, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?vfs=%s&%s", name, vfsName, params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func countRows(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM books").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func insertRows(db *sql.DB, from, to int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := from; i < to; i++ {
+		_, err = tx.Exec("INSERT INTO books (id, title) VALUES (?, ?)", i, fmt.Sprintf("book %d", i))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func TestJournalModes(t *testing.T) {
+	for _, mode := range []string{"DELETE", "TRUNCATE", "PERSIST"} {
+		t.Run(mode, func(t *testing.T) {
+			testJournalMode(t, mode)
+		})
+		t.Run(mode+"/copy-on-write", func(t *testing.T) {
+			testJournalMode(t, mode, WithCopyOnWrite())
+		})
+		t.Run(mode+"/write-buffer", func(t *testing.T) {
+			testJournalMode(t, mode, WithWriteBuffer(16))
+		})
+		t.Run(mode+"/read-cache", func(t *testing.T) {
+			testJournalMode(t, mode, WithReadCache(64))
+		})
+		t.Run(mode+"/sector-size", func(t *testing.T) {
+			testJournalMode(t, mode, WithSectorSize(256*1024))
+		})
+		t.Run(mode+"/compression", func(t *testing.T) {
+			testJournalMode(t, mode, WithCompression(CompressionGzip))
+		})
+		t.Run(mode+"/encryption", func(t *testing.T) {
+			keys, err := NewKeyring("key", map[string][]byte{"key": randomBytes(t, KeySize)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			testJournalMode(t, mode, WithEncryption(keys))
+		})
+		t.Run(mode+"/sparse-zeros", func(t *testing.T) {
+			testJournalMode(t, mode, WithSparseZeros())
+		})
+		t.Run(mode+"/copy-on-write-and-write-buffer", func(t *testing.T) {
+			testJournalMode(t, mode, WithCopyOnWrite(), WithWriteBuffer(16))
+		})
+	}
+}
+
+func testJournalMode(t *testing.T, mode string, opts ...Option) {
+	v, _ := newTestVFS(t, opts...)
+	db := openTestDB(t, v, "journal.db", "_journal="+mode)
+	defer db.Close()
+
+	_, err := db.Exec("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertRows(db, 0, 200); err != nil {
+		t.Fatal(err)
+	}
+	if got := countRows(t, db); got != 200 {
+		t.Errorf("got %d rows, expected 200", got)
+	}
+
+	exists, err := v.Access("journal.db-journal", sqlite3vfs.AccessExists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists && mode != "PERSIST" {
+		t.Errorf("journal still exists after commit in %s mode", mode)
+	}
+}
+
+// A pod dying after writing some of the database, but before the journal is finished with
+// should be rolled back by the next user of the file
+func TestHotJournalRollback(t *testing.T) {
+	for _, mode := range []string{"DELETE", "TRUNCATE"} {
+		t.Run(mode, func(t *testing.T) {
+			kc := fake.NewSimpleClientset()
+			trackResourceVersions(kc)
+			// Only crash during the transaction we want to be rolled back
+			var armed, crashed atomic.Bool
+			journalMetadata := NewFile("crash.db-journal", &vfs{}).MetadataName()
+			kc.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if crashed.Load() {
+					return true, nil, errors.New("pod has crashed")
+				}
+				if !armed.Load() {
+					return false, nil, nil
+				}
+				// The journal being emptied is the commit
+				if a, ok := action.(k8stesting.UpdateAction); ok && action.GetVerb() == "update" {
+					cm, ok := a.GetObject().(*v1.ConfigMap)
+					if !ok || cm.Name != journalMetadata || cm.Data["size"] != "0" {
+						return false, nil, nil
+					}
+					existing, err := kc.Tracker().Get(action.GetResource(), action.GetNamespace(), cm.Name)
+					if err == nil && existing.(*v1.ConfigMap).Data["size"] != "0" {
+						crashed.Store(true)
+						return true, nil, errors.New("pod has crashed")
+					}
+				}
+				return false, nil, nil
+			})
+
+			va := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 1, WithHolderIdentity("crashing"), WithLockTTL(200*time.Millisecond))
+			dba := openTestDB(t, va, "crash.db", "_journal="+mode)
+			_, err := dba.Exec("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := insertRows(dba, 0, 100); err != nil {
+				t.Fatal(err)
+			}
+
+			armed.Store(true)
+			if err := insertRows(dba, 100, 300); err == nil {
+				t.Fatal("expected the commit to fail")
+			}
+			if !crashed.Load() {
+				t.Fatal("never reached the commit")
+			}
+			dba.Close()
+
+			// Wait for the crashed pod's locks to expire
+			armed.Store(false)
+			crashed.Store(false)
+			time.Sleep(300 * time.Millisecond)
+
+			vb := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, WithHolderIdentity("restarted"))
+			dbb := openTestDB(t, vb, "crash.db", "_journal="+mode)
+			defer dbb.Close()
+
+			if got := countRows(t, dbb); got != 100 {
+				t.Errorf("got %d rows after recovery, expected the 100 committed before the crash", got)
+			}
+			var check string
+			if err := dbb.QueryRow("PRAGMA integrity_check").Scan(&check); err != nil {
+				t.Fatal(err)
+			}
+			if check != "ok" {
+				t.Errorf("integrity check failed: %s", check)
+			}
+		})
+	}
+}
+
+func TestWAL(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"plain":              nil,
+		"write buffer":       {WithWriteBuffer(256)},
+		"copy-on-write":      {WithCopyOnWrite()},
+		"read cache":         {WithReadCache(256)},
+		"buffered cow cache": {WithWriteBuffer(256), WithCopyOnWrite(), WithReadCache(256)},
+		"read-ahead":         {WithSectorSize(1024), WithReadCache(256), WithReadAhead(4)},
+	} {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			testWAL(t, "wal-"+strings.ReplaceAll(name, " ", "-")+".db", opts...)
+		})
+	}
+}
+
+// Each database gets its own name, as the wal-index is shared by everything in the process
+func testWAL(t *testing.T, name string, opts ...Option) {
+	v, _ := newTestVFS(t, append([]Option{WithWAL()}, opts...)...)
+	if v.cache != nil {
+		t.Error("read cache is on in WAL mode")
+	}
+	writer := openTestDB(t, v, name, "_journal=WAL")
+	defer writer.Close()
+
+	var mode string
+	if err := writer.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Fatalf("journal mode is %q, expected wal", mode)
+	}
+	if _, err := writer.Exec("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertRows(writer, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers carry on with what was committed while someone is writing
+	reader := openTestDB(t, v, name, "_journal=WAL&_busy_timeout=0")
+	defer reader.Close()
+	tx, err := writer.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO books (id, title) VALUES (100, 'uncommitted')"); err != nil {
+		t.Fatal(err)
+	}
+	if got := countRows(t, reader); got != 100 {
+		t.Errorf("reader got %d rows during a write, expected 100", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := countRows(t, reader); got != 101 {
+		t.Errorf("reader got %d rows after the commit, expected 101", got)
+	}
+
+	// Checkpoints write the database while the reader holds on to it
+	for i := 0; i < 3; i++ {
+		title := fmt.Sprintf("edition %d", i)
+		if _, err := writer.Exec("UPDATE books SET title = ?", title); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			t.Fatal(err)
+		}
+		var stale int
+		if err := reader.QueryRow("SELECT COUNT(*) FROM books WHERE title != ?", title).Scan(&stale); err != nil {
+			t.Fatal(err)
+		}
+		if stale != 0 {
+			t.Errorf("reader got %d rows from before checkpoint %d", stale, i)
+		}
+	}
+
+	reader.Close()
+	writer.Close()
+	again := openTestDB(t, v, name, "_journal=WAL")
+	defer again.Close()
+	if got := countRows(t, again); got != 101 {
+		t.Errorf("got %d rows after reopening, expected 101", got)
+	}
+}
+
+func TestWALNeedsOption(t *testing.T) {
+	v, _ := newTestVFS(t)
+	db := openTestDB(t, v, "nowal.db", "")
+	defer db.Close()
+
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "delete" {
+		t.Errorf("journal mode is %q without WithWAL, expected it to stay delete", mode)
+	}
+}
@@ -0,0 +1,255 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// lease is our hold on a database in exclusive process mode.
+// Every open handle of the database in this vfs shares it, and the lock state lives here rather than in the lockfile.
+type lease struct {
+	name string
+	file string
+	refs int
+	mu   sync.Mutex
+	st   *lockState
+	// expires is when someone else could take the lease as of our last renewal, in unix nanoseconds
+	expires atomic.Int64
+	lost    atomic.Bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// check fails once we can't be sure the lease is still ours, so nothing is read or written after someone else could have taken it
+func (l *lease) check() error {
+	if l.lost.Load() || time.Now().UnixNano() >= l.expires.Load() {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// update is updateLock for the lock state we keep in memory
+func (l *lease) update(fn func(st *lockState) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return fn(l.st)
+}
+
+func (f *file) LeaseName() string {
+	return fmt.Sprintf("%s-%s", f.id, LeaseNameSuffix)
+}
+
+// checkLease fails if the file is leased and we've lost the lease
+func (f *file) checkLease() error {
+	if f.lease == nil {
+		return nil
+	}
+	return f.lease.check()
+}
+
+func (v *vfs) leaseClient() coordinationv1client.LeaseInterface {
+	return v.kc.CoordinationV1().Leases(v.namespace)
+}
+
+// leaseDuration is the lock TTL in whole seconds, which is all a Lease can hold
+func (v *vfs) leaseDuration() int32 {
+	seconds := int32((v.lockTTL + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+func leaseExpired(l *coordinationv1.Lease, now time.Time) bool {
+	if l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+func leaseHolder(l *coordinationv1.Lease) string {
+	if l.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *l.Spec.HolderIdentity
+}
+
+// acquireLease takes the lease on f's database, or shares the one we already hold
+func (v *vfs) acquireLease(f *file) (*lease, error) {
+	v.leaseMu.Lock()
+	defer v.leaseMu.Unlock()
+
+	if l, ok := v.leases[f.id]; ok && !l.lost.Load() {
+		l.refs++
+		return l, nil
+	}
+
+	name := f.LeaseName()
+	start := time.Now()
+	err := v.api.do(v.ctx, "AcquireLease", func(ctx context.Context) error {
+		return v.takeLease(ctx, name, f.id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	v.logger.Debugw("Acquired lease", "name", name)
+
+	l := &lease{name: name, file: f.id, refs: 1, st: newLockState(), stop: make(chan struct{}), done: make(chan struct{})}
+	l.expires.Store(start.Add(v.lockTTL).UnixNano())
+	v.leases[f.id] = l
+	// Whoever held it before could have changed anything
+	if v.cache != nil {
+		v.cache.invalidateFile(f.fileKey())
+	}
+	go v.renewLease(l)
+	return l, nil
+}
+
+// takeLease makes us the holder, as long as nobody else holds it
+func (v *vfs) takeLease(ctx context.Context, name, file string) error {
+	now := metav1.NewMicroTime(time.Now())
+	duration := v.leaseDuration()
+	holder := v.holderIdentity
+
+	l, err := v.leaseClient().Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		labels := map[string]string{"relevant-file": file}
+		for k, val := range LeaseLabel {
+			labels[k] = val
+		}
+		_, err = v.leaseClient().Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if kerrors.IsAlreadyExists(err) {
+			return ErrLockConflict
+		}
+		return apiError(err)
+	} else if err != nil {
+		return apiError(err)
+	}
+
+	if h := leaseHolder(l); h != "" && h != holder && !leaseExpired(l, now.Time) {
+		v.logger.Warnw("Lease is held by someone else", "name", name, "holder", h)
+		return ErrLockConflict
+	}
+	if leaseHolder(l) != holder {
+		transitions := int32(1)
+		if l.Spec.LeaseTransitions != nil {
+			transitions += *l.Spec.LeaseTransitions
+		}
+		l.Spec.LeaseTransitions = &transitions
+		l.Spec.AcquireTime = &now
+	}
+	l.Spec.HolderIdentity = &holder
+	l.Spec.LeaseDurationSeconds = &duration
+	l.Spec.RenewTime = &now
+	_, err = v.leaseClient().Update(ctx, l, metav1.UpdateOptions{})
+	if kerrors.IsConflict(err) {
+		return ErrLockConflict
+	}
+	return apiError(err)
+}
+
+// renewLease keeps the lease until it's released, or until we can't be sure it's still ours
+func (v *vfs) renewLease(l *lease) {
+	defer close(l.done)
+	ticker := time.NewTicker(v.lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-v.ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			err := v.api.do(exemptFromFailFast(v.ctx), "RenewLease", func(ctx context.Context) error {
+				return v.extendLease(ctx, l.name)
+			})
+			switch {
+			case err == nil:
+				l.expires.Store(start.Add(v.lockTTL).UnixNano())
+			case errors.Is(err, ErrLeaseLost):
+				l.lost.Store(true)
+				v.logger.Errorw("Lease was taken by someone else", "name", l.name)
+				return
+			default:
+				v.logger.Warnw("Failed to renew lease", "name", l.name, "err", err)
+				if time.Now().UnixNano() >= l.expires.Load() {
+					l.lost.Store(true)
+					v.logger.Errorw("Lease expired before it was renewed", "name", l.name)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (v *vfs) extendLease(ctx context.Context, name string) error {
+	l, err := v.leaseClient().Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return ErrLeaseLost
+	} else if err != nil {
+		return apiError(err)
+	}
+	if leaseHolder(l) != v.holderIdentity {
+		return ErrLeaseLost
+	}
+	now := metav1.NewMicroTime(time.Now())
+	l.Spec.RenewTime = &now
+	_, err = v.leaseClient().Update(ctx, l, metav1.UpdateOptions{})
+	return apiError(err)
+}
+
+// releaseLease gives the lease up once the last handle using it is closed
+func (v *vfs) releaseLease(l *lease) {
+	v.leaseMu.Lock()
+	defer v.leaseMu.Unlock()
+
+	l.refs--
+	if l.refs > 0 {
+		return
+	}
+	if v.leases[l.file] == l {
+		delete(v.leases, l.file)
+	}
+	close(l.stop)
+	<-l.done
+	if l.lost.Load() {
+		return
+	}
+
+	err := v.api.do(exemptFromFailFast(v.ctx), "ReleaseLease", func(ctx context.Context) error {
+		ls, err := v.leaseClient().Get(ctx, l.name, metav1.GetOptions{})
+		if err != nil {
+			return apiError(err)
+		}
+		if leaseHolder(ls) != v.holderIdentity {
+			return nil
+		}
+		ls.Spec.HolderIdentity = nil
+		_, err = v.leaseClient().Update(ctx, ls, metav1.UpdateOptions{})
+		return apiError(err)
+	})
+	if err != nil {
+		// It'll expire anyway
+		v.logger.Warnw("Failed to release lease", "name", l.name, "err", err)
+		return
+	}
+	v.logger.Debugw("Released lease", "name", l.name)
+}
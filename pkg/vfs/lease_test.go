@@ -0,0 +1,197 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func getLease(t *testing.T, v *vfs, f *file) *coordinationv1.Lease {
+	t.Helper()
+	l, err := v.leaseClient().Get(context.TODO(), f.LeaseName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestExclusiveProcess(t *testing.T) {
+	v, kc := newTestVFS(t, WithExclusiveProcess(), WithHolderIdentity("a"))
+
+	f := openTestFile(t, v, "exclusive.db")
+	if h := leaseHolder(getLease(t, v, f)); h != "a" {
+		t.Fatalf("lease is held by %q after opening", h)
+	}
+
+	kc.ClearActions()
+	for _, lock := range []sqlite3vfs.LockType{sqlite3vfs.LockShared, sqlite3vfs.LockReserved, sqlite3vfs.LockExclusive} {
+		if err := f.Lock(lock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reserved, err := f.reservedLockHeld()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Error("expected a reserved lock to be reported")
+	}
+	if err := f.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+	if actions := kc.Actions(); len(actions) != 0 {
+		t.Errorf("locking made %d API calls, expected none: %v", len(actions), actions)
+	}
+	if _, err := kc.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), f.LockFileName(), metav1.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected no lockfile, got %v", err)
+	}
+
+	// Handles in the same vfs share the lease, and still exclude each other
+	g := openTestFile(t, v, "exclusive.db")
+	if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Lock(sqlite3vfs.LockReserved); err != sqlite3vfs.BusyError {
+		t.Errorf("second reserved lock returned %v, expected %v", err, sqlite3vfs.BusyError)
+	}
+	if err := f.Lock(sqlite3vfs.LockExclusive); err != sqlite3vfs.BusyError {
+		t.Errorf("exclusive lock with another reader returned %v, expected %v", err, sqlite3vfs.BusyError)
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if h := leaseHolder(getLease(t, v, f)); h != "a" {
+		t.Fatalf("lease is held by %q while a handle is still open", h)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if h := leaseHolder(getLease(t, v, f)); h != "" {
+		t.Errorf("lease is still held by %q after closing", h)
+	}
+}
+
+func TestExclusiveProcessRefusesOthers(t *testing.T) {
+	va, kc := newTestVFS(t, WithExclusiveProcess(), WithHolderIdentity("a"))
+	vb := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 0, WithContext(va.ctx), WithExclusiveProcess(), WithHolderIdentity("b"))
+
+	fa := openTestFile(t, va, "refused.db")
+	_, _, err := vb.Open("refused.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	if err != sqlite3vfs.BusyError {
+		t.Fatalf("opening a leased database returned %v, expected %v", err, sqlite3vfs.BusyError)
+	}
+
+	if err := fa.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fb := openTestFile(t, vb, "refused.db")
+	defer fb.Close()
+	if l := getLease(t, vb, fb); leaseHolder(l) != "b" || l.Spec.LeaseTransitions == nil || *l.Spec.LeaseTransitions != 1 {
+		t.Errorf("expected b to have taken over the lease, got %+v", l.Spec)
+	}
+}
+
+func TestExclusiveProcessTakesExpiredLease(t *testing.T) {
+	v, _ := newTestVFS(t, WithExclusiveProcess())
+
+	crashed := "crashed"
+	duration := int32(1)
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	f := NewFile("expired.db", v)
+	_, err := v.leaseClient().Create(context.TODO(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: f.LeaseName()},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &crashed, LeaseDurationSeconds: &duration, RenewTime: &renewed},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f = openTestFile(t, v, "expired.db")
+	defer f.Close()
+	if h := leaseHolder(getLease(t, v, f)); h != v.holderIdentity {
+		t.Errorf("expired lease is held by %q", h)
+	}
+}
+
+func TestExclusiveProcessLeaseLost(t *testing.T) {
+	v, _ := newTestVFS(t, WithExclusiveProcess(), WithLockTTL(300*time.Millisecond))
+
+	f := openTestFile(t, v, "lost.db")
+	if _, err := f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else takes over, which we notice on the next renewal
+	l := getLease(t, v, f)
+	thief := "thief"
+	l.Spec.HolderIdentity = &thief
+	if _, err := v.leaseClient().Update(context.TODO(), l, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !f.lease.lost.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("lease wasn't noticed to be lost")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := f.readAt(make([]byte, 5), 0); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("readAt returned %v, expected %v", err, ErrLeaseLost)
+	}
+	if _, err := f.ReadAt(make([]byte, 5), 0); err != sqlite3vfs.IOErrorRead {
+		t.Errorf("ReadAt returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+	}
+	if _, err := f.WriteAt([]byte("world"), 0); err != sqlite3vfs.IOErrorWrite {
+		t.Errorf("WriteAt returned %v, expected %v", err, sqlite3vfs.IOErrorWrite)
+	}
+	if err := f.Lock(sqlite3vfs.LockReserved); err != sqlite3vfs.BusyError {
+		t.Errorf("Lock returned %v, expected %v", err, sqlite3vfs.BusyError)
+	}
+
+	// Closing doesn't take the lease back from its new holder
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if h := leaseHolder(getLease(t, v, NewFile("lost.db", v))); h != thief {
+		t.Errorf("lease is held by %q after closing, expected %q", h, thief)
+	}
+}
+
+func TestExclusiveProcessDB(t *testing.T) {
+	v, kc := newTestVFS(t, WithExclusiveProcess())
+	db := openTestDB(t, v, "exclusive-sql.db", "_journal=DELETE")
+	defer db.Close()
+
+	_, err := db.Exec("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertRows(db, 0, 50); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db); n != 50 {
+		t.Errorf("got %d rows, expected 50", n)
+	}
+	lockfile := NewFile("exclusive-sql.db", v).LockFileName()
+	if _, err := kc.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), lockfile, metav1.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected no lockfile for the database, got %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+)
+
+const (
+	DefaultLockTTL = 30 * time.Second
+	// MinLockTTL leaves time to renew locks, which happens every third of the TTL
+	MinLockTTL = 10 * time.Millisecond
+	// How many times to re-read the lockfile when someone else changed it under us
+	maxLockConflictRetries = 10
+)
+
+// lockState is stored as JSON in the lockfile.
+// Each vfs is a holder, and each open file within it is a handle.
+type lockState struct {
+	// Shared is how many handles of each holder have at least a SHARED lock
+	Shared map[string]int `json:"shared"`
+	// Writer is the handle holding RESERVED, PENDING or EXCLUSIVE, if any
+	WriterHolder string              `json:"writerHolder,omitempty"`
+	WriterHandle uint64              `json:"writerHandle,omitempty"`
+	WriterLevel  sqlite3vfs.LockType `json:"writerLevel,omitempty"`
+	// Expires is when each holder's locks are treated as abandoned
+	Expires map[string]time.Time `json:"expires"`
+	// Commits counts how many times an EXCLUSIVE lock has been released, so readers know when their cache is stale
+	Commits uint64 `json:"commits,omitempty"`
+}
+
+func newLockState() *lockState {
+	return &lockState{Shared: map[string]int{}, Expires: map[string]time.Time{}}
+}
+
+// pruneExpired drops the locks of holders which haven't renewed them in time
+func (st *lockState) pruneExpired(now time.Time) []string {
+	expired := []string{}
+	for holder, expires := range st.Expires {
+		if now.After(expires) {
+			expired = append(expired, holder)
+			delete(st.Expires, holder)
+			delete(st.Shared, holder)
+			if st.WriterHolder == holder {
+				// They could have written anything before they died
+				if st.WriterLevel == sqlite3vfs.LockExclusive {
+					st.Commits += 1
+				}
+				st.clearWriter()
+			}
+		}
+	}
+	return expired
+}
+
+func (st *lockState) clearWriter() {
+	st.WriterHolder = ""
+	st.WriterHandle = 0
+	st.WriterLevel = sqlite3vfs.LockNone
+}
+
+func (st *lockState) isWriter(f *file) bool {
+	return st.WriterHolder == f.vfs.holderIdentity && st.WriterHandle == f.handle
+}
+
+// otherShared counts the SHARED locks held by handles other than f
+func (st *lockState) otherShared(f *file) int {
+	total := 0
+	for holder, n := range st.Shared {
+		total += n
+		if holder == f.vfs.holderIdentity {
+			total -= 1
+		}
+	}
+	return total
+}
+
+// highestLock is only informational, to make the lockfile easier to read
+func (st *lockState) highestLock() sqlite3vfs.LockType {
+	if st.WriterLevel > sqlite3vfs.LockNone {
+		return st.WriterLevel
+	}
+	for _, n := range st.Shared {
+		if n > 0 {
+			return sqlite3vfs.LockShared
+		}
+	}
+	return sqlite3vfs.LockNone
+}
+
+func (f *file) LockFileName() string {
+	localLockFileName := fmt.Sprintf("%s-%s", f.id, LockFileNameSuffix)
+	return localLockFileName
+}
+
+func (f *file) lockRecord(st *lockState, resourceVersion string) (*Record, error) {
+	LockfileLabels := make(map[string]string)
+	for k, v := range LockfileLabel {
+		LockfileLabels[k] = v
+	}
+	fileNameLabel := f.id
+
+	LockfileLabels["relevant-file"] = fileNameLabel
+
+	state, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Record{
+		Name:            f.LockFileName(),
+		Labels:          LockfileLabels,
+		Data:            map[string]string{"lock": st.highestLock().String(), "state": string(state), "relevant-file": fileNameLabel, "filename": f.RawName},
+		ResourceVersion: resourceVersion,
+	}, nil
+}
+
+// createLockFile makes an empty lockfile, it's fine if someone else beat us to it
+func (f *file) createLockFile(ctx context.Context) error {
+	lf, err := f.lockRecord(newLockState(), "")
+	if err != nil {
+		return err
+	}
+	err = f.vfs.store.PutLock(ctx, lf)
+	if err == errConflict {
+		return nil
+	}
+	return err
+}
+
+func (f *file) getLockState(ctx context.Context) (*lockState, string, error) {
+	lf, err := f.vfs.store.GetLock(ctx, f.LockFileName())
+	if err != nil {
+		return nil, "", err
+	}
+
+	st := newLockState()
+	// Lockfiles from before holders were tracked don't have any state, treat them as unlocked
+	if s, ok := lf.Data["state"]; ok {
+		err = json.Unmarshal([]byte(s), st)
+		if err != nil {
+			f.vfs.logger.Errorw("lockfile has invalid state", "name", f.LockFileName(), "err", err)
+			return nil, "", err
+		}
+	}
+	if st.Shared == nil {
+		st.Shared = map[string]int{}
+	}
+	if st.Expires == nil {
+		st.Expires = map[string]time.Time{}
+	}
+	if expired := st.pruneExpired(time.Now()); len(expired) > 0 {
+		f.vfs.logger.Warnw("Ignoring expired locks", "name", f.LockFileName(), "holders", expired)
+	}
+
+	return st, lf.ResourceVersion, nil
+}
+
+// updateLock applies fn to the current lock state and stores the result.
+// If someone else changed the lockfile in the meantime it starts again with the new state.
+func (f *file) updateLock(ctx context.Context, fn func(st *lockState) error) error {
+	if f.lease != nil {
+		return f.lease.update(fn)
+	}
+	for i := 0; i < maxLockConflictRetries; i++ {
+		start := time.Now()
+		st, resourceVersion, err := f.getLockState(ctx)
+		if err == errRecordNotFound {
+			err = f.createLockFile(ctx)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = fn(st)
+		if err != nil {
+			return err
+		}
+		st.Expires[f.vfs.holderIdentity] = time.Now().Add(f.vfs.lockTTL)
+
+		lf, err := f.lockRecord(st, resourceVersion)
+		if err != nil {
+			return err
+		}
+		err = f.vfs.store.PutLock(ctx, lf)
+		if err == errConflict {
+			f.vfs.logger.Debugw("updateLock lockfile changed underneath us, retrying", "name", f.LockFileName())
+			if err := f.vfs.retry.wait(ctx, i, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil {
+			f.lockExpires.Store(start.Add(f.vfs.lockTTL).UnixNano())
+		}
+		return err
+	}
+
+	return ErrLockConflict
+}
+
+// checkLock fails once our locks could have expired, so nothing is written after someone else could have taken them
+func (f *file) checkLock() error {
+	if err := f.checkLease(); err != nil {
+		return err
+	}
+	if f.lockLost.Load() {
+		return ErrLockLost
+	}
+	if expires := f.lockExpires.Load(); expires != 0 && time.Now().UnixNano() >= expires {
+		return ErrLockLost
+	}
+	return nil
+}
+
+func (f *file) Lock(elock sqlite3vfs.LockType) error {
+	err := f.lock(elock)
+	if errors.Is(err, ErrLeaseLost) || errors.Is(err, ErrLockLost) {
+		return sqlite3vfs.BusyError
+	}
+	return sqliteError(err, sqlite3vfs.IOError)
+}
+
+func (f *file) lock(elock sqlite3vfs.LockType) error {
+	f.vfs.logger.Debugw("Lock", "elock", elock)
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+
+	currentLock := f.lockLevel
+
+	//    UNLOCKED -> SHARED
+	//    SHARED -> RESERVED
+	//    SHARED -> (PENDING) -> EXCLUSIVE
+	//    RESERVED -> (PENDING) -> EXCLUSIVE
+	//    PENDING -> EXCLUSIVE
+
+	if elock <= currentLock {
+		return nil
+	}
+	// Locking again from NONE is how a handle recovers from losing its locks
+	checkErr := f.checkLock()
+	if currentLock == sqlite3vfs.LockNone {
+		checkErr = f.checkLease()
+	}
+	if checkErr != nil {
+		return checkErr
+	}
+
+	//  (1) We never move from unlocked to anything higher than shared lock.
+	if currentLock == sqlite3vfs.LockNone && elock > sqlite3vfs.LockShared {
+		return errors.New("invalid lock transition requested")
+	}
+	//  (2) SQLite never explicitly requests a pendig lock.
+	if elock == sqlite3vfs.LockPending {
+		return errors.New("invalid Lock() request for state pending")
+	}
+	//  (3) A shared lock is always held when a reserve lock is requested.
+	if elock == sqlite3vfs.LockReserved && currentLock != sqlite3vfs.LockShared {
+		return errors.New("can only transition to Reserved lock from Shared lock")
+	}
+
+	var (
+		err     error
+		commits uint64
+	)
+	switch elock {
+	case sqlite3vfs.LockShared:
+		err = f.updateLock(f.vfs.ctx, func(st *lockState) error {
+			// A pending lock stops new readers so the writer can finish
+			if st.WriterLevel >= sqlite3vfs.LockPending {
+				return ErrLockConflict
+			}
+			st.Shared[f.vfs.holderIdentity] += 1
+			commits = st.Commits
+			return nil
+		})
+		if err == nil && f.cached() {
+			f.vfs.cache.sawCommits(f.fileKey(), commits)
+		}
+	case sqlite3vfs.LockReserved:
+		err = f.updateLock(f.vfs.ctx, func(st *lockState) error {
+			if st.WriterLevel > sqlite3vfs.LockNone {
+				return ErrLockConflict
+			}
+			st.WriterHolder = f.vfs.holderIdentity
+			st.WriterHandle = f.handle
+			st.WriterLevel = sqlite3vfs.LockReserved
+			return nil
+		})
+	case sqlite3vfs.LockExclusive:
+		if currentLock < sqlite3vfs.LockPending {
+			err = f.updateLock(f.vfs.ctx, func(st *lockState) error {
+				if st.WriterLevel > sqlite3vfs.LockNone && !st.isWriter(f) {
+					return ErrLockConflict
+				}
+				st.WriterHolder = f.vfs.holderIdentity
+				st.WriterHandle = f.handle
+				st.WriterLevel = sqlite3vfs.LockPending
+				return nil
+			})
+			if err != nil {
+				break
+			}
+			f.setLockLevel(sqlite3vfs.LockPending)
+		}
+		// Keep PENDING until the readers have gone, SQLite will call us again
+		err = f.updateLock(f.vfs.ctx, func(st *lockState) error {
+			if !st.isWriter(f) {
+				f.vfs.logger.Errorw("Lost our pending lock", "name", f.LockFileName())
+				return ErrLockConflict
+			}
+			if st.otherShared(f) > 0 {
+				return ErrLockConflict
+			}
+			st.WriterLevel = sqlite3vfs.LockExclusive
+			return nil
+		})
+	}
+	f.vfs.logger.Debugw("Lock", "elock", elock, "err", err)
+	if err != nil {
+		return err
+	}
+
+	if currentLock == sqlite3vfs.LockNone {
+		f.lockLost.Store(false)
+	}
+	f.setLockLevel(elock)
+	return nil
+}
+
+func (f *file) Unlock(elock sqlite3vfs.LockType) error {
+	return sqliteError(f.unlock(elock), sqlite3vfs.IOError)
+}
+
+func (f *file) unlock(elock sqlite3vfs.LockType) error {
+	f.vfs.logger.Debugw("Unlock", "elock", elock)
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+
+	currentLock := f.lockLevel
+
+	if elock > sqlite3vfs.LockShared {
+		f.vfs.logger.Errorw("Invalid unlock request", "elock", elock)
+		return fmt.Errorf("invalid unlock request to level %s", elock)
+	}
+
+	if elock >= currentLock {
+		return nil
+	}
+
+	// Nobody else should get in before our writes are committed, SQLite doesn't always Sync first
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	err = f.commit()
+	if err != nil {
+		return err
+	}
+
+	var (
+		commits   uint64
+		committed bool
+	)
+	// Releasing what we hold always goes ahead, whatever the rate limit
+	err = f.updateLock(exemptFromFailFast(f.vfs.ctx), func(st *lockState) error {
+		committed = false
+		if st.isWriter(f) {
+			if st.WriterLevel == sqlite3vfs.LockExclusive {
+				st.Commits += 1
+				committed = true
+			}
+			st.clearWriter()
+		}
+		commits = st.Commits
+		if elock == sqlite3vfs.LockNone {
+			st.Shared[f.vfs.holderIdentity] -= 1
+			if st.Shared[f.vfs.holderIdentity] <= 0 {
+				delete(st.Shared, f.vfs.holderIdentity)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		f.vfs.logger.Error(err)
+		return err
+	}
+	if committed && f.cached() {
+		f.vfs.cache.committed(f.fileKey(), commits)
+	}
+
+	f.setLockLevel(elock)
+	return nil
+}
+
+// CheckReservedLock reports whether anyone holds RESERVED or higher
+func (f *file) CheckReservedLock() (bool, error) {
+	held, err := f.reservedLockHeld()
+	return held, sqliteError(err, sqlite3vfs.IOError)
+}
+
+func (f *file) reservedLockHeld() (bool, error) {
+	if f.lease != nil {
+		var held bool
+		err := f.lease.update(func(st *lockState) error {
+			held = st.WriterLevel >= sqlite3vfs.LockReserved
+			return nil
+		})
+		return held, err
+	}
+	st, _, err := f.getLockState(f.vfs.ctx)
+	if err == errRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		f.vfs.logger.Error(err)
+		return false, err
+	}
+
+	return st.WriterLevel >= sqlite3vfs.LockReserved, nil
+}
+
+// setLockLevel records the lock this handle holds, and keeps it renewed while it's held.
+// Must be called with lockMu held.
+func (f *file) setLockLevel(lock sqlite3vfs.LockType) {
+	f.lockLevel = lock
+	if lock != sqlite3vfs.LockShared {
+		f.stopReadAhead()
+	}
+	if lock == sqlite3vfs.LockNone {
+		f.lockExpires.Store(0)
+	}
+	// Leased files' locks are only in memory, and the lease is renewed instead
+	if lock > sqlite3vfs.LockNone && f.stopRenew == nil && f.lease == nil {
+		f.stopRenew = make(chan struct{})
+		go f.renewLock(f.stopRenew)
+	} else if lock == sqlite3vfs.LockNone && f.stopRenew != nil {
+		close(f.stopRenew)
+		f.stopRenew = nil
+	}
+}
+
+// renewLock stops our locks from expiring while they're still in use
+func (f *file) renewLock(stop chan struct{}) {
+	ticker := time.NewTicker(f.vfs.lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-f.vfs.ctx.Done():
+			return
+		case <-ticker.C:
+			err := f.updateLock(exemptFromFailFast(f.vfs.ctx), func(st *lockState) error {
+				if st.Shared[f.vfs.holderIdentity] == 0 {
+					return ErrLockLost
+				}
+				return nil
+			})
+			if errors.Is(err, ErrLockLost) {
+				f.vfs.logger.Errorw("Our lock expired before it was renewed", "name", f.LockFileName())
+				f.lockLost.Store(true)
+				return
+			} else if err != nil {
+				f.vfs.logger.Errorw("Failed to renew lock", "name", f.LockFileName(), "err", err)
+				if expires := f.lockExpires.Load(); expires != 0 && time.Now().UnixNano() >= expires {
+					f.vfs.logger.Errorw("Our lock expired while it couldn't be renewed", "name", f.LockFileName())
+					f.lockLost.Store(true)
+					return
+				}
+			}
+		}
+	}
+}
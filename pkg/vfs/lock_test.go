@@ -0,0 +1,295 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLock(t *testing.T) {
+	v, _ := newTestVFS(t)
+	f := openTestFile(t, v, "lock.db")
+
+	reserved, err := f.CheckReservedLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved {
+		t.Error("new file reports a reserved lock")
+	}
+
+	if err := f.Lock(sqlite3vfs.LockExclusive); err == nil {
+		t.Error("expected moving from no lock to exclusive to fail")
+	}
+	if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Lock(sqlite3vfs.LockPending); err == nil {
+		t.Error("expected an explicit pending lock request to fail")
+	}
+	if err := f.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Lock(sqlite3vfs.LockExclusive); err != nil {
+		t.Fatal(err)
+	}
+
+	reserved, err = f.CheckReservedLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Error("expected a reserved lock to be reported")
+	}
+
+	if err := f.Unlock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if f.lockLevel != sqlite3vfs.LockShared {
+		t.Errorf("lock is %s after unlocking to shared", f.lockLevel)
+	}
+	reserved, _ = f.CheckReservedLock()
+	if reserved {
+		t.Error("reserved lock still reported after unlocking to shared")
+	}
+	if err := f.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockBetweenHolders(t *testing.T) {
+	va, kc := newTestVFS(t, WithHolderIdentity("a"))
+	vb := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, WithHolderIdentity("b"))
+
+	fa := openTestFile(t, va, "shared.db")
+	fb := openTestFile(t, vb, "shared.db")
+	defer fa.Close()
+	defer fb.Close()
+
+	if err := fa.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fa.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Lock(sqlite3vfs.LockReserved); err != sqlite3vfs.BusyError {
+		t.Errorf("second reserved lock returned %v, expected busy", err)
+	}
+
+	// b is still reading, so a can only get as far as pending
+	if err := fa.Lock(sqlite3vfs.LockExclusive); err != sqlite3vfs.BusyError {
+		t.Errorf("exclusive lock with another reader returned %v, expected busy", err)
+	}
+	if err := fb.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+	// and pending keeps new readers out
+	if err := fb.Lock(sqlite3vfs.LockShared); err != sqlite3vfs.BusyError {
+		t.Errorf("shared lock while pending returned %v, expected busy", err)
+	}
+	if err := fa.Lock(sqlite3vfs.LockExclusive); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fa.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockHandlesInOneVFS(t *testing.T) {
+	v, _ := newTestVFS(t)
+	f1 := openTestFile(t, v, "handles.db")
+	f2 := openTestFile(t, v, "handles.db")
+	defer f1.Close()
+	defer f2.Close()
+
+	if err := f1.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := f2.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatal(err)
+	}
+	if err := f2.Lock(sqlite3vfs.LockReserved); err != sqlite3vfs.BusyError {
+		t.Errorf("second reserved lock in the same vfs returned %v, expected busy", err)
+	}
+	if err := f1.Lock(sqlite3vfs.LockExclusive); err != sqlite3vfs.BusyError {
+		t.Errorf("exclusive lock with another handle reading returned %v, expected busy", err)
+	}
+	if err := f2.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.Lock(sqlite3vfs.LockExclusive); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockExpires(t *testing.T) {
+	va, kc := newTestVFS(t, WithHolderIdentity("crashed"), WithLockTTL(100*time.Millisecond))
+	vb := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, WithHolderIdentity("b"))
+
+	fa := openTestFile(t, va, "expire.db")
+	fb := openTestFile(t, vb, "expire.db")
+
+	if err := fa.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fa.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash by no longer renewing the lock
+	fa.lockMu.Lock()
+	close(fa.stopRenew)
+	fa.stopRenew = nil
+	fa.lockMu.Unlock()
+
+	if err := fb.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Lock(sqlite3vfs.LockReserved); err != sqlite3vfs.BusyError {
+		t.Errorf("reserved lock returned %v before the old one expired, expected busy", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := fb.Lock(sqlite3vfs.LockExclusive); err != nil {
+		t.Errorf("exclusive lock failed after the old holder expired: %v", err)
+	}
+}
+
+func TestLockTTLInvalid(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Second, 2} {
+		for _, exclusive := range []bool{false, true} {
+			opts := []Option{WithLockTTL(ttl)}
+			if exclusive {
+				opts = append(opts, WithExclusiveProcess())
+			}
+			v, _ := newTestVFS(t, opts...)
+			if v.lockTTL != DefaultLockTTL {
+				t.Errorf("lock TTL of %s became %s, expected the default", ttl, v.lockTTL)
+			}
+			// Starts renewing the lock or lease, which used to panic
+			f := openTestFile(t, v, fmt.Sprintf("ttl-%t.db", exclusive))
+			if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestLockLostWhileWriting(t *testing.T) {
+	va, kc := newTestVFS(t, WithHolderIdentity("a"), WithLockTTL(200*time.Millisecond))
+	vb := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, WithContext(va.ctx), WithHolderIdentity("b"))
+
+	// Nobody can update anything during the outage, so a's locks expire
+	var outage atomic.Bool
+	kc.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if outage.Load() {
+			return true, nil, kerrors.NewServiceUnavailable("outage")
+		}
+		return false, nil, nil
+	})
+
+	fa := openTestFile(t, va, "lost.db")
+	fb := openTestFile(t, vb, "lost.db")
+	if err := fa.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fa.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fa.WriteAt([]byte("before"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	outage.Store(true)
+	time.Sleep(300 * time.Millisecond)
+	outage.Store(false)
+
+	if _, err := fa.writeAt([]byte("after"), 0); !errors.Is(err, ErrLockLost) {
+		t.Errorf("writeAt returned %v after the lock expired, expected %v", err, ErrLockLost)
+	}
+	if err := fb.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Lock(sqlite3vfs.LockReserved); err != nil {
+		t.Fatalf("reserved lock failed after a's expired: %v", err)
+	}
+
+	if _, err := fa.WriteAt([]byte("after"), 0); err != sqlite3vfs.IOErrorWrite {
+		t.Errorf("WriteAt returned %v, expected %v", err, sqlite3vfs.IOErrorWrite)
+	}
+	if err := fa.Sync(sqlite3vfs.SyncNormal); err != sqlite3vfs.IOError {
+		t.Errorf("Sync returned %v, expected %v", err, sqlite3vfs.IOError)
+	}
+	if err := fa.Lock(sqlite3vfs.LockExclusive); err != sqlite3vfs.BusyError {
+		t.Errorf("Lock returned %v, expected %v", err, sqlite3vfs.BusyError)
+	}
+
+	// Starting again from NONE is fine
+	if err := fa.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := fa.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := fa.checkLock(); err != nil {
+		t.Errorf("lock is still lost after locking again: %v", err)
+	}
+}
+
+func TestLockConcurrentUpdates(t *testing.T) {
+	_, kc := newTestVFS(t)
+
+	holders := 8
+	var wg sync.WaitGroup
+	files := make([]*file, holders)
+	for i := 0; i < holders; i++ {
+		v := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, WithHolderIdentity(fmt.Sprintf("holder-%d", i)))
+		files[i] = openTestFile(t, v, "concurrent.db")
+	}
+	for _, f := range files {
+		wg.Add(1)
+		go func(f *file) {
+			defer wg.Done()
+			if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+				t.Error(err)
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	st, _, err := files[0].getLockState(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Shared) != holders {
+		t.Errorf("expected %d shared holders, lockfile has %v", holders, st.Shared)
+	}
+}
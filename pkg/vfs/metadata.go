@@ -0,0 +1,317 @@
+package vfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fileMetadata is stored in a single configmap per file so that the size can be found
+// without listing every sector
+type fileMetadata struct {
+	Size    int64
+	Sectors int64
+	Version int
+	// SectorSize is how many bytes each sector of this file holds, fixed when the file is created
+	SectorSize int64
+	// Generation counts copy-on-write commits
+	Generation int64
+	// Manifest is which generation of each sector is current, sectors not in it are generation 0
+	Manifest map[int64]int64
+	// ResourceVersion is what this was read at, so it's only replaced if nobody else changed it
+	ResourceVersion string
+}
+
+func (m *fileMetadata) copy() *fileMetadata {
+	c := *m
+	c.Manifest = make(map[int64]int64, len(m.Manifest))
+	for k, v := range m.Manifest {
+		c.Manifest[k] = v
+	}
+	return &c
+}
+
+func (m *fileMetadata) resize(size int64) {
+	m.Size = size
+	m.Sectors = sectorsForSize(size, m.SectorSize)
+}
+
+// compact forgets about sectors past the end, and ones removed during a transaction
+func (m *fileMetadata) compact() {
+	for index, generation := range m.Manifest {
+		if index >= m.Sectors || generation == removedGeneration {
+			delete(m.Manifest, index)
+		}
+	}
+}
+
+// formatVersion is the oldest format which can hold m, so older versions can still read files they understand
+func (m *fileMetadata) formatVersion() int {
+	if m.SectorSize != SectorSize {
+		return 3
+	}
+	if len(m.Manifest) > 0 {
+		return 2
+	}
+	return 1
+}
+
+func (f *file) MetadataName() string {
+	return fmt.Sprintf("%s-%s", f.id, MetadataNameSuffix)
+}
+
+func (f *file) metadataLabels() map[string]string {
+	l := make(map[string]string)
+	for k, v := range MetadataLabel {
+		l[k] = v
+	}
+	l["relevant-file"] = f.id
+	return l
+}
+
+// sectorsForSize returns how many sectors of sectorSize are needed to hold size bytes
+func sectorsForSize(size, sectorSize int64) int64 {
+	return (size + sectorSize - 1) / sectorSize
+}
+
+func (f *file) getMetadata() (*fileMetadata, error) {
+	f.vfs.logger.Debugw("getMetadata", "name", f.MetadataName())
+
+	r, err := f.fetchMetadata()
+	if err == errRecordNotFound {
+		// Files written before metadata existed, work it out the slow way once
+		return f.rebuildMetadata()
+	} else if err != nil {
+		f.vfs.logger.Error(err)
+		return nil, err
+	}
+
+	m, err := f.parseMetadata(r)
+	if err != nil {
+		return nil, err
+	}
+	f.meta = m
+
+	return m, nil
+}
+
+// fetchMetadata gets the metadata from the read cache if we can, otherwise the store
+func (f *file) fetchMetadata() (*Record, error) {
+	if !f.cached() {
+		return f.vfs.store.GetMetadata(f.vfs.ctx, f.MetadataName())
+	}
+	if r, ok := f.vfs.cache.getMetadata(f.fileKey(), f.MetadataName()); ok {
+		return r, nil
+	}
+	r, err := f.vfs.store.GetMetadata(f.vfs.ctx, f.MetadataName())
+	if err != nil {
+		return nil, err
+	}
+	f.vfs.cache.putMetadata(f.fileKey(), r)
+
+	return r, nil
+}
+
+func (f *file) parseMetadata(r *Record) (*fileMetadata, error) {
+	var err error
+	m := &fileMetadata{}
+	m.Size, err = strconv.ParseInt(r.Data["size"], 10, 64)
+	if err != nil {
+		f.vfs.logger.Errorw("metadata has invalid size", "name", f.MetadataName(), "err", err)
+		return nil, corrupt(err)
+	}
+	m.Sectors, err = strconv.ParseInt(r.Data["sectors"], 10, 64)
+	if err != nil {
+		f.vfs.logger.Errorw("metadata has invalid sector count", "name", f.MetadataName(), "err", err)
+		return nil, corrupt(err)
+	}
+	m.Version, err = strconv.Atoi(r.Data["version"])
+	if err != nil {
+		f.vfs.logger.Errorw("metadata has invalid version", "name", f.MetadataName(), "err", err)
+		return nil, corrupt(err)
+	}
+	if m.Version > MetadataFormatVersion {
+		return nil, fmt.Errorf("metadata format version %d is newer than supported version %d", m.Version, MetadataFormatVersion)
+	}
+	// Files from before the sector size could be changed all use the default
+	m.SectorSize = SectorSize
+	if ss, ok := r.Data["sectorSize"]; ok {
+		m.SectorSize, err = strconv.ParseInt(ss, 10, 64)
+		if err != nil || m.SectorSize <= 0 {
+			f.vfs.logger.Errorw("metadata has invalid sector size", "name", f.MetadataName(), "sectorSize", ss, "err", err)
+			return nil, corrupt(fmt.Errorf("invalid sector size %q", ss))
+		}
+	}
+	if g, ok := r.Data["generation"]; ok {
+		m.Generation, err = strconv.ParseInt(g, 10, 64)
+		if err != nil {
+			f.vfs.logger.Errorw("metadata has invalid generation", "name", f.MetadataName(), "err", err)
+			return nil, corrupt(err)
+		}
+	}
+	m.Manifest = map[int64]int64{}
+	if manifest, ok := r.Data["manifest"]; ok {
+		err = json.Unmarshal([]byte(manifest), &m.Manifest)
+		if err != nil {
+			f.vfs.logger.Errorw("metadata has invalid manifest", "name", f.MetadataName(), "err", err)
+			return nil, corrupt(err)
+		}
+	}
+	m.ResourceVersion = r.ResourceVersion
+	f.vfs.logger.Debugw("getMetadata", "metadata", m)
+
+	return m, nil
+}
+
+// exists reports whether the file has been created and has some data in it, like unix's access()
+func (f *file) exists() (bool, error) {
+	r, err := f.vfs.store.GetMetadata(f.vfs.ctx, f.MetadataName())
+	if err == errRecordNotFound {
+		// SQLite looks for a hot journal on every transaction, too often to list sectors each time,
+		// so only main databases get checked for being from before metadata
+		if f.journal() {
+			return false, nil
+		}
+		// Don't create metadata for a file that isn't there, or write anything just to answer
+		m, err := f.legacyMetadata()
+		if err != nil {
+			return false, err
+		}
+		return m.Size > 0, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	m, err := f.parseMetadata(r)
+	if err != nil {
+		return false, err
+	}
+
+	return m.Size > 0, nil
+}
+
+// journal reports whether the file is a rollback journal or WAL, going by the names SQLite gives them
+func (f *file) journal() bool {
+	return strings.HasSuffix(f.RawName, "-journal") || strings.HasSuffix(f.RawName, "-wal")
+}
+
+// rebuildMetadata works out the metadata from the existing sectors and stores it
+func (f *file) rebuildMetadata() (*fileMetadata, error) {
+	f.vfs.logger.Debugw("rebuildMetadata", "name", f.MetadataName())
+
+	m, err := f.legacyMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return m, f.setMetadata(m)
+}
+
+// legacyMetadata works out the metadata of a file from before metadata existed from its sectors
+func (f *file) legacyMetadata() (*fileMetadata, error) {
+	// Older files with data in them were written with the default sector size, new ones get ours
+	m := &fileMetadata{Manifest: map[int64]int64{}, SectorSize: SectorSize}
+	// So the last sector is read with the old sector size
+	f.meta = m
+	lastSector, err := f.getLastSector()
+	if err == nil {
+		m.Size = lastSector.Index*SectorSize + int64(len(lastSector.Data))
+	} else if err != errNoSectors {
+		return nil, err
+	}
+	if m.Size == 0 {
+		m.SectorSize = f.vfs.sectorSize
+	}
+	m.Sectors = sectorsForSize(m.Size, m.SectorSize)
+
+	return m, nil
+}
+
+func (f *file) setMetadata(m *fileMetadata) error {
+	f.vfs.logger.Debugw("setMetadata", "metadata", m)
+
+	m.Version = m.formatVersion()
+	r := &Record{
+		Name:   f.MetadataName(),
+		Labels: f.metadataLabels(),
+		Data: map[string]string{
+			"filename": f.RawName,
+			"size":     strconv.FormatInt(m.Size, 10),
+			"sectors":  strconv.FormatInt(m.Sectors, 10),
+			"version":  strconv.Itoa(m.Version),
+		},
+		ResourceVersion: m.ResourceVersion,
+	}
+	if m.SectorSize != SectorSize {
+		r.Data["sectorSize"] = strconv.FormatInt(m.SectorSize, 10)
+	}
+	if m.Generation > 0 {
+		r.Data["generation"] = strconv.FormatInt(m.Generation, 10)
+	}
+	if len(m.Manifest) > 0 {
+		manifest, err := json.Marshal(m.Manifest)
+		if err != nil {
+			return err
+		}
+		r.Data["manifest"] = string(manifest)
+	}
+
+	err := f.vfs.store.PutMetadata(f.vfs.ctx, r)
+	if err == errConflict {
+		if f.cached() {
+			f.vfs.cache.remove(f.fileKey(), f.MetadataName())
+		}
+		f.vfs.logger.Errorw("Metadata was changed by someone else since it was read, refusing to overwrite it", "name", f.MetadataName(), "resourceVersion", m.ResourceVersion)
+		return err
+	} else if err != nil {
+		f.vfs.logger.Error(err)
+		return err
+	}
+	m.ResourceVersion = r.ResourceVersion
+	f.meta = m
+	if f.cached() {
+		f.vfs.cache.putMetadata(f.fileKey(), r)
+	}
+
+	return nil
+}
+
+// setSize records a new logical size for the file
+func (f *file) setSize(size int64) error {
+	m := &fileMetadata{SectorSize: f.sectorSize()}
+	if f.meta != nil {
+		m = f.meta.copy()
+	}
+	m.resize(size)
+	m.compact()
+	return f.setMetadata(m)
+}
+
+// empty shrinks the file to nothing if it has metadata, on top of the version we read so nobody else's changes are overwritten
+func (f *file) empty() error {
+	r, err := f.fetchMetadata()
+	if err == errRecordNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	m, err := f.parseMetadata(r)
+	if err != nil {
+		return err
+	}
+	f.meta = m
+	return f.setSize(0)
+}
+
+func (f *file) deleteMetadata() error {
+	if f.cached() {
+		f.vfs.cache.remove(f.fileKey(), f.MetadataName())
+	}
+	err := f.vfs.store.DeleteMetadata(f.vfs.ctx, f.MetadataName())
+	f.vfs.logger.Debugw("deleteMetadata", "name", f.MetadataName(), "err", err)
+	if err == errRecordNotFound {
+		return nil
+	}
+
+	return err
+}
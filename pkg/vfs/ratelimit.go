@@ -0,0 +1,63 @@
+package vfs
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit caps how fast the vfs calls the API server, on top of whatever the client's own QPS and Burst allow
+type RateLimit struct {
+	// QPS is the sustained rate of calls, 0 means no limit
+	QPS float64
+	// Burst is how many calls can be made at once after a quiet spell
+	Burst int
+	// FailFast fails calls with ErrBudgetExceeded when the budget is used up, rather than waiting for it to refill.
+	// A runaway query then gets errors instead of keeping the API server busy.
+	FailFast bool
+}
+
+// limiter returns the token bucket for l, or nil if there's no limit
+func (l RateLimit) limiter() *rate.Limiter {
+	if l.QPS <= 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(l.QPS), burst)
+}
+
+// exemptKey marks calls which keep hold of what we already have, like renewing and releasing locks
+type exemptKey struct{}
+
+// exemptFromFailFast makes calls with ctx go ahead even once the budget is used up in FailFast mode,
+// so running out stops queries rather than losing our locks. They still use up tokens.
+func exemptFromFailFast(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exemptKey{}, true)
+}
+
+// take waits for a token, or fails straight away in FailFast mode
+func (s *apiStore) take(ctx context.Context, op string) error {
+	if s.limiter == nil {
+		return nil
+	}
+	if s.limit.FailFast && ctx.Value(exemptKey{}) != nil {
+		// Borrowed from the calls after it if there aren't any left
+		s.limiter.Reserve()
+		return nil
+	}
+	if s.limit.FailFast {
+		if !s.limiter.Allow() {
+			s.logger.Warnw("API budget exceeded", "op", op, "qps", s.limit.QPS, "burst", s.limit.Burst)
+			return ErrBudgetExceeded
+		}
+		return nil
+	}
+	err := s.limiter.Wait(ctx)
+	if err != nil {
+		return apiError(err)
+	}
+	return nil
+}
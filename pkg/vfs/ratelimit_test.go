@@ -0,0 +1,113 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newLimitedStore(t *testing.T, l RateLimit) *apiStore {
+	kc := fake.NewSimpleClientset()
+	return &apiStore{store: NewConfigMapStore(kc, testNamespace, zaptest.NewLogger(t).Sugar()), limit: l, limiter: l.limiter(), logger: zaptest.NewLogger(t).Sugar()}
+}
+
+func TestRateLimitWaits(t *testing.T) {
+	s := newLimitedStore(t, RateLimit{QPS: 100, Burst: 1})
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if _, err := s.GetLock(context.Background(), "lockfile"); err != errRecordNotFound {
+			t.Fatalf("GetLock returned %v, expected %v", err, errRecordNotFound)
+		}
+	}
+	// The first call is free, the other five wait 10ms each
+	if took := time.Since(start); took < 40*time.Millisecond {
+		t.Errorf("6 calls at 100 QPS took %s", took)
+	}
+}
+
+func TestRateLimitFailFast(t *testing.T) {
+	s := newLimitedStore(t, RateLimit{QPS: 0.001, Burst: 3, FailFast: true})
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetLock(context.Background(), "lockfile"); err != errRecordNotFound {
+			t.Fatalf("GetLock %d returned %v, expected %v", i, err, errRecordNotFound)
+		}
+	}
+	if _, err := s.GetLock(context.Background(), "lockfile"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("GetLock over budget returned %v, expected %v", err, ErrBudgetExceeded)
+	}
+}
+
+func TestRateLimitFailFastVFS(t *testing.T) {
+	v, _ := newTestVFS(t, WithRateLimit(RateLimit{QPS: 0.001, Burst: 50, FailFast: true}))
+	f := openTestFile(t, v, "budget.db")
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for i := 0; i < 50 && err == nil; i++ {
+		_, err = f.ReadAt(make([]byte, 4), 0)
+	}
+	if err != sqlite3vfs.IOErrorRead {
+		t.Errorf("ReadAt once the budget was used up returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+	}
+}
+
+func TestRateLimitFailFastExempt(t *testing.T) {
+	s := newLimitedStore(t, RateLimit{QPS: 0.001, Burst: 1, FailFast: true})
+	if _, err := s.GetLock(context.Background(), "lockfile"); err != errRecordNotFound {
+		t.Fatalf("GetLock returned %v, expected %v", err, errRecordNotFound)
+	}
+	if _, err := s.GetLock(context.Background(), "lockfile"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("GetLock over budget returned %v, expected %v", err, ErrBudgetExceeded)
+	}
+	if _, err := s.GetLock(exemptFromFailFast(context.Background()), "lockfile"); err != errRecordNotFound {
+		t.Errorf("exempt GetLock over budget returned %v, expected %v", err, errRecordNotFound)
+	}
+}
+
+// Using up the budget stops queries, but we keep renewing what we hold
+func TestRateLimitFailFastKeepsLocks(t *testing.T) {
+	for name, exclusive := range map[string]bool{"lockfile": false, "lease": true} {
+		exclusive := exclusive
+		t.Run(name, func(t *testing.T) {
+			opts := []Option{WithLockTTL(300 * time.Millisecond), WithRateLimit(RateLimit{QPS: 0.001, Burst: 50, FailFast: true})}
+			if exclusive {
+				opts = append(opts, WithExclusiveProcess())
+			}
+			v, _ := newTestVFS(t, opts...)
+			f := openTestFile(t, v, "renewed.db")
+			if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			for i := 0; i < 50 && err == nil; i++ {
+				_, err = f.ReadAt(make([]byte, 4), 0)
+			}
+			if err != sqlite3vfs.IOErrorRead {
+				t.Fatalf("ReadAt once the budget was used up returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+			}
+
+			time.Sleep(500 * time.Millisecond)
+			if err := f.checkLock(); err != nil {
+				t.Errorf("lost our lock while over budget: %v", err)
+			}
+			if err := f.Unlock(sqlite3vfs.LockNone); err != nil {
+				t.Errorf("Unlock over budget returned %v", err)
+			}
+		})
+	}
+}
+
+func TestNoRateLimit(t *testing.T) {
+	if l := (RateLimit{Burst: 10}).limiter(); l != nil {
+		t.Errorf("got a limiter without a QPS")
+	}
+}
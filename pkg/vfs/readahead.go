@@ -0,0 +1,110 @@
+package vfs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/psanford/sqlite3vfs"
+)
+
+// readAhead spots SQLite reading a file in order, as it does for table scans, and fetches the next
+// sectors into the read cache in the background so they're already there when it asks for them.
+// It only runs while we hold just a SHARED lock, as that's when the cache can be trusted and nobody's writing.
+// That isn't true in WAL mode, where checkpoints write the database while everyone holds SHARED, so it's off then.
+type readAhead struct {
+	// last is the last sector read, and fetchedTo the last one fetched or being fetched
+	started   bool
+	last      int64
+	fetchedTo int64
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// readingAhead is told about every read, and starts fetching ahead of sequential ones
+func (f *file) readingAhead(firstSector, lastSector, fileSize int64) {
+	if f.vfs.readAhead <= 0 || !f.cached() || f.vfs.wal {
+		return
+	}
+	f.lockMu.Lock()
+	level := f.lockLevel
+	f.lockMu.Unlock()
+	if level != sqlite3vfs.LockShared {
+		return
+	}
+
+	a := &f.ahead
+	sequential := a.started && (firstSector == a.last || firstSector == a.last+1)
+	movedOn := lastSector > a.last
+	if a.started && !sequential {
+		f.vfs.logger.Debugw("Reads aren't sequential, stopping read-ahead", "name", f.RawName, "sector", firstSector, "last", a.last)
+		f.stopReadAhead()
+	}
+	a.started = true
+	a.last = lastSector
+	if !sequential || !movedOn {
+		return
+	}
+
+	from := lastSector + 1
+	if a.fetchedTo >= from {
+		from = a.fetchedTo + 1
+	}
+	to := lastSector + int64(f.vfs.readAhead)
+	if end := sectorsForSize(fileSize, f.sectorSize()) - 1; to > end {
+		to = end
+	}
+	if from > to {
+		return
+	}
+	a.fetchedTo = to
+
+	// Work out the names now, the metadata isn't safe to look at from another goroutine
+	names := make([]string, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		if _, ok := f.dirty[i]; ok || f.generationOf(i) == removedGeneration {
+			continue
+		}
+		names = append(names, f.sectorNameFromSectorIndex(i))
+	}
+	if a.ctx == nil {
+		a.ctx, a.cancel = context.WithCancel(f.vfs.ctx)
+	}
+	f.vfs.logger.Debugw("Reading ahead", "name", f.RawName, "from", from, "to", to)
+	a.wg.Add(1)
+	go f.prefetch(a.ctx, &a.wg, f.fileKey(), names)
+}
+
+// prefetch puts the sectors called names in the read cache, unless they're there already
+func (f *file) prefetch(ctx context.Context, wg *sync.WaitGroup, key string, names []string) {
+	defer wg.Done()
+	for _, name := range names {
+		if f.vfs.cache.get(key, name) != nil {
+			continue
+		}
+		sr, err := f.vfs.store.GetSector(ctx, name)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == ErrSectorMissing {
+			continue
+		} else if err != nil {
+			f.vfs.logger.Debugw("Read-ahead failed", "sector", name, "err", err)
+			return
+		}
+		f.vfs.cache.putFetched(key, sr)
+	}
+}
+
+// stopReadAhead cancels any fetches in progress, and waits for them so nothing is cached after we let go of our lock
+func (f *file) stopReadAhead() {
+	a := &f.ahead
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.wg.Wait()
+	a.started = false
+	a.fetchedTo = 0
+	a.ctx = nil
+	a.cancel = nil
+}
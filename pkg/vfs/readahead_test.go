@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+)
+
+const readAheadSectorSize = 1024
+
+// newReadAheadTest has a file of 10 sectors written by someone else, so none of it is cached yet
+func newReadAheadTest(t *testing.T, wrap func(SectorStore) SectorStore) *file {
+	t.Helper()
+	writer, kc := newTestVFS(t, WithSectorSize(readAheadSectorSize))
+	writeLocked(t, openTestFile(t, writer, "scan.db"), randomBytes(t, 10*readAheadSectorSize))
+
+	logger := zaptest.NewLogger(t).Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	v := NewVFS(kc, testNamespace, logger, 2, WithContext(ctx), WithSectorStore(wrap(NewConfigMapStore(kc, testNamespace, logger))),
+		WithOpTimeout(0), WithReadCache(64), WithReadAhead(4))
+	f := openTestFile(t, v, "scan.db")
+	if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func readSector(t *testing.T, f *file, index int64) {
+	t.Helper()
+	if _, err := f.ReadAt(make([]byte, 100), index*readAheadSectorSize+10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isCached(f *file, index int64) bool {
+	return f.vfs.cache.get(f.fileKey(), f.sectorNameFromSectorIndex(index)) != nil
+}
+
+func TestReadAhead(t *testing.T) {
+	f := newReadAheadTest(t, func(s SectorStore) SectorStore { return s })
+
+	readSector(t, f, 0)
+	readSector(t, f, 0)
+	if isCached(f, 1) {
+		t.Error("read ahead before the reads moved on")
+	}
+	readSector(t, f, 1)
+
+	deadline := time.Now().Add(time.Second)
+	for i := int64(2); i <= 5; i++ {
+		for !isCached(f, i) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if !isCached(f, i) {
+			t.Errorf("sector %d wasn't read ahead", i)
+		}
+	}
+	f.stopReadAhead()
+	if isCached(f, 6) {
+		t.Error("read more than 4 sectors ahead")
+	}
+
+	// Reading to the end doesn't go past it
+	for i := int64(2); i < 10; i++ {
+		readSector(t, f, i)
+	}
+	if f.ahead.fetchedTo != 9 {
+		t.Errorf("read ahead to sector %d, expected to stop at the last one", f.ahead.fetchedTo)
+	}
+}
+
+func TestReadAheadOffInWAL(t *testing.T) {
+	f := newReadAheadTest(t, func(s SectorStore) SectorStore { return s })
+	// Checkpoints write the database while every connection holds SHARED
+	f.vfs.wal = true
+	readSector(t, f, 0)
+	readSector(t, f, 1)
+	if f.ahead.ctx != nil {
+		t.Error("read ahead in WAL mode")
+	}
+}
+
+func TestReadAheadCancelled(t *testing.T) {
+	var store *hangingStore
+	f := newReadAheadTest(t, func(s SectorStore) SectorStore {
+		store = &hangingStore{SectorStore: s}
+		return store
+	})
+	readSector(t, f, 1)
+	readSector(t, f, 0)
+
+	// Read ahead from now on never finishes on its own
+	store.hang.Store(true)
+	for _, tc := range []struct {
+		name string
+		stop func()
+	}{
+		{"reads jump back", func() { readSector(t, f, 0) }},
+		{"write lock taken", func() {
+			if err := f.Lock(sqlite3vfs.LockReserved); err != nil {
+				t.Error(err)
+			}
+		}},
+	} {
+		readSector(t, f, 1)
+		done := make(chan struct{})
+		go func() {
+			tc.stop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("read ahead wasn't cancelled when the %s", tc.name)
+		}
+	}
+
+	// No more reading ahead while we could be writing
+	readSector(t, f, 0)
+	readSector(t, f, 1)
+	if f.ahead.ctx != nil {
+		t.Error("read ahead while holding a write lock")
+	}
+}
@@ -0,0 +1,61 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// RetryPolicy is how calls to the API server are retried when it can't answer,
+// and how long read-modify-write loops back off after losing a race
+type RetryPolicy struct {
+	// Retries is how many more times to try after the first attempt
+	Retries int
+	// MinBackoff is the wait before the first retry, which doubles each time up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used by NewVFS, with Retries set from its retries argument
+var DefaultRetryPolicy = RetryPolicy{Retries: 3, MinBackoff: 20 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+// retriable is true for errors which mean the API server couldn't answer, such as 429s, 5xxs and timeouts.
+// Conflicts aren't, as the same request would just conflict again, they're retried by whoever can re-read the object.
+func retriable(err error) bool {
+	return errors.Is(err, ErrAPIUnavailable)
+}
+
+// backoff is how long to wait before retrying after attempt failed with err.
+// The API server's Retry-After wins, up to MaxBackoff, otherwise it's exponential with jitter so clients which failed together don't all come back together.
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	if seconds, ok := kerrors.SuggestsClientDelay(err); ok && seconds > 0 {
+		d := time.Duration(seconds) * time.Second
+		if p.MaxBackoff > 0 && d > p.MaxBackoff {
+			d = p.MaxBackoff
+		}
+		return d
+	}
+	d := p.MinBackoff << attempt
+	if d > p.MaxBackoff || d <= 0 {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// wait sleeps before the next attempt, returning ctx's error if it's done first
+func (p RetryPolicy) wait(ctx context.Context, attempt int, err error) error {
+	t := time.NewTimer(p.backoff(attempt, err))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
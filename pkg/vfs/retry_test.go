@@ -0,0 +1,196 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Retries: 5, MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for attempt, max := range []time.Duration{10, 20, 40, 50, 50, 50} {
+		max *= time.Millisecond
+		if d := p.backoff(attempt, nil); d < max/2 || d > max {
+			t.Errorf("backoff for attempt %d is %s, expected between %s and %s", attempt, d, max/2, max)
+		}
+	}
+
+	throttled := apiError(kerrors.NewTooManyRequests("slow down", 3))
+	if d := p.backoff(0, throttled); d != p.MaxBackoff {
+		t.Errorf("backoff with a Retry-After over MaxBackoff is %s, expected %s", d, p.MaxBackoff)
+	}
+	p.MaxBackoff = 10 * time.Second
+	if d := p.backoff(0, throttled); d != 3*time.Second {
+		t.Errorf("backoff with Retry-After is %s, expected 3s", d)
+	}
+}
+
+// failFirst makes the first n calls matching verb and resource fail with err
+func failFirst(kc fakeClient, verb, resource string, n int, err error) *int {
+	calls := 0
+	kc.PrependReactor(verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		calls++
+		if calls <= n {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+	return &calls
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	policy := RetryPolicy{Retries: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"too many requests", kerrors.NewTooManyRequests("slow down", 0)},
+		{"unavailable", kerrors.NewServiceUnavailable("down")},
+		{"internal error", kerrors.NewInternalError(errors.New("etcd fell over"))},
+		{"timeout", kerrors.NewTimeoutError("took too long", 0)},
+		{"no answer", errors.New("connection refused")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, kc := newTestVFS(t, WithRetryPolicy(policy))
+			f := openTestFile(t, v, "retry.db")
+			if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := failFirst(kc, "get", "configmaps", 3, tc.err)
+			b := make([]byte, 4)
+			if _, err := f.ReadAt(b, 0); err != nil {
+				t.Fatalf("ReadAt returned %v after %d calls", err, *calls)
+			}
+			if string(b) != "data" {
+				t.Errorf("read %q, expected %q", b, "data")
+			}
+
+			calls = failFirst(kc, "update", "configmaps", 4, tc.err)
+			if _, err := f.WriteAt([]byte("more"), 0); err != sqlite3vfs.IOErrorWrite {
+				t.Errorf("WriteAt returned %v once out of retries, expected %v", err, sqlite3vfs.IOErrorWrite)
+			}
+			if *calls != 4 {
+				t.Errorf("tried the update %d times, expected 4", *calls)
+			}
+		})
+	}
+}
+
+func TestRetryOnlyTransientErrors(t *testing.T) {
+	v, kc := newTestVFS(t, WithRetryPolicy(RetryPolicy{Retries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	f := openTestFile(t, v, "forbidden.db")
+
+	calls := failFirst(kc, "get", "configmaps", 1, kerrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "retry.db", errors.New("no")))
+	if _, err := f.ReadAt(make([]byte, 4), 0); err != sqlite3vfs.IOErrorRead {
+		t.Errorf("ReadAt returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+	}
+	if *calls != 1 {
+		t.Errorf("forbidden get was tried %d times, expected once", *calls)
+	}
+}
+
+func TestRetryOpenAndDeleteOnce(t *testing.T) {
+	policy := RetryPolicy{Retries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	v, kc := newTestVFS(t, WithRetryPolicy(policy))
+	f := openTestFile(t, v, "once.db")
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Open and Delete only try again after races, the store has already retried API errors
+	down := kerrors.NewServiceUnavailable("down")
+	calls := failFirst(kc, "list", "configmaps", 100, down)
+	if err := v.Delete("once.db", false); err != sqlite3vfs.IOError {
+		t.Errorf("Delete returned %v, expected %v", err, sqlite3vfs.IOError)
+	}
+	if *calls != 4 {
+		t.Errorf("listed sectors %d times, expected 4", *calls)
+	}
+
+	calls = failFirst(kc, "create", "configmaps", 100, down)
+	if _, _, err := v.Open("new.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite); err != sqlite3vfs.IOError {
+		t.Errorf("Open returned %v, expected %v", err, sqlite3vfs.IOError)
+	}
+	if *calls != 4 {
+		t.Errorf("created the lockfile %d times, expected 4", *calls)
+	}
+}
+
+// lostReplyStore applies writes but loses the answer to the next few, like a timeout on the way back
+type lostReplyStore struct {
+	SectorStore
+	lose atomic.Int32
+}
+
+func (s *lostReplyStore) lost(resourceVersion *string, previous string) bool {
+	if s.lose.Add(-1) < 0 {
+		return false
+	}
+	// We never heard what the new version is
+	*resourceVersion = previous
+	return true
+}
+
+func (s *lostReplyStore) PutSector(ctx context.Context, sr *SectorRecord) error {
+	previous := sr.ResourceVersion
+	err := s.SectorStore.PutSector(ctx, sr)
+	if err == nil && s.lost(&sr.ResourceVersion, previous) {
+		return apiError(context.DeadlineExceeded)
+	}
+	return err
+}
+
+func (s *lostReplyStore) PutMetadata(ctx context.Context, r *Record) error {
+	previous := r.ResourceVersion
+	err := s.SectorStore.PutMetadata(ctx, r)
+	if err == nil && s.lost(&r.ResourceVersion, previous) {
+		return apiError(context.DeadlineExceeded)
+	}
+	return err
+}
+
+func TestRetryAppliedWrite(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	trackResourceVersions(kc)
+	logger := zaptest.NewLogger(t).Sugar()
+	store := &lostReplyStore{SectorStore: NewConfigMapStore(kc, testNamespace, logger)}
+	v := NewVFS(kc, testNamespace, logger, 2, WithSectorStore(store), WithRetryPolicy(RetryPolicy{Retries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	f := openTestFile(t, v, "applied.db")
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Creating a sector and updating the metadata, whose retries both conflict with themselves
+	store.lose.Store(2)
+	data := []byte("more data")
+	if _, err := f.WriteAt(data, SectorSize); err != nil {
+		t.Fatalf("WriteAt returned %v after its first attempts were applied", err)
+	}
+	if n := store.lose.Load(); n > 0 {
+		t.Fatalf("only %d of the writes lost their answer", 2-n)
+	}
+	b := make([]byte, len(data))
+	if _, err := f.ReadAt(b, SectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("read %q, expected %q", b, data)
+	}
+
+	// Our version of the metadata is the latest, so writing again works
+	if _, err := f.WriteAt(data, 2*SectorSize); err != nil {
+		t.Fatal(err)
+	}
+}
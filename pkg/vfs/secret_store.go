@@ -0,0 +1,236 @@
+package vfs
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// secretStore keeps sectors, lock files and metadata in Secrets, so reading them needs secret RBAC
+// rather than configmap RBAC. Names and labels are the same as configMapStore's.
+type secretStore struct {
+	kc        kubernetes.Interface
+	namespace string
+	logger    *zap.SugaredLogger
+}
+
+func NewSecretStore(kc kubernetes.Interface, namespace string, logger *zap.SugaredLogger) *secretStore {
+	return &secretStore{kc: kc, namespace: namespace, logger: logger}
+}
+
+func (s *secretStore) Ping(ctx context.Context) error {
+	return apiError(serverVersion(ctx, s.kc.Discovery()))
+}
+
+func (s *secretStore) GetSector(ctx context.Context, name string) (*SectorRecord, error) {
+	secret, err := s.kc.CoreV1().Secrets(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, ErrSectorMissing
+	} else if err != nil {
+		return nil, apiError(err)
+	}
+
+	return sectorRecordFromSecret(secret), nil
+}
+
+func (s *secretStore) PutSector(ctx context.Context, sr *SectorRecord) error {
+	data := stringsToBytes(sr.Attributes)
+	data["sector"] = sr.Data
+	secret := &v1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sr.Name,
+			Namespace:       s.namespace,
+			Labels:          sr.Labels,
+			ResourceVersion: sr.ResourceVersion,
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}
+
+	var (
+		written *v1.Secret
+		err     error
+	)
+	if sr.ResourceVersion == "" {
+		written, err = s.kc.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		written, err = s.kc.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) || kerrors.IsNotFound(err) {
+		s.logger.Debugw("PutSector conflict", "name", sr.Name, "resourceVersion", sr.ResourceVersion, "err", err)
+		return errConflict
+	} else if err != nil {
+		return apiError(err)
+	}
+	sr.ResourceVersion = written.ResourceVersion
+
+	return nil
+}
+
+func (s *secretStore) DeleteSector(ctx context.Context, name string) error {
+	err := s.kc.CoreV1().Secrets(s.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return ErrSectorMissing
+	}
+
+	return apiError(err)
+}
+
+func (s *secretStore) ListSectors(ctx context.Context, l map[string]string) ([]*SectorRecord, error) {
+	secrets, err := s.kc.CoreV1().Secrets(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(l).String()})
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	sectors := make([]*SectorRecord, 0, len(secrets.Items))
+	for i := range secrets.Items {
+		sectors = append(sectors, sectorRecordFromSecret(&secrets.Items[i]))
+	}
+
+	return sectors, nil
+}
+
+func (s *secretStore) WatchSectors(ctx context.Context, l map[string]string, changed func(sr *SectorRecord, deleted bool)) error {
+	w, err := s.kc.CoreV1().Secrets(s.namespace).Watch(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(l).String()})
+	if err != nil {
+		return apiError(err)
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+			if ev.Type == watch.Error {
+				return kerrors.FromObject(ev.Object)
+			}
+			secret, ok := ev.Object.(*v1.Secret)
+			if !ok {
+				continue
+			}
+			changed(sectorRecordFromSecret(secret), ev.Type == watch.Deleted)
+		}
+	}
+}
+
+func (s *secretStore) GetLock(ctx context.Context, name string) (*Record, error) {
+	return s.getRecord(ctx, name)
+}
+
+func (s *secretStore) PutLock(ctx context.Context, r *Record) error {
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: r.Name, Labels: r.Labels, ResourceVersion: r.ResourceVersion}, Type: v1.SecretTypeOpaque, Data: stringsToBytes(r.Data)}
+
+	var err error
+	if r.ResourceVersion == "" {
+		_, err = s.kc.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		_, err = s.kc.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) || kerrors.IsNotFound(err) {
+		return errConflict
+	}
+
+	return apiError(err)
+}
+
+func (s *secretStore) DeleteLock(ctx context.Context, name string) error {
+	return s.deleteRecord(ctx, name)
+}
+
+func (s *secretStore) GetMetadata(ctx context.Context, name string) (*Record, error) {
+	return s.getRecord(ctx, name)
+}
+
+func (s *secretStore) PutMetadata(ctx context.Context, r *Record) error {
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: r.Name, Labels: r.Labels, ResourceVersion: r.ResourceVersion}, Type: v1.SecretTypeOpaque, Data: stringsToBytes(r.Data)}
+
+	var (
+		written *v1.Secret
+		err     error
+	)
+	// Without a resourceVersion it's a new file, which mustn't overwrite one someone else just created
+	if r.ResourceVersion == "" {
+		written, err = s.kc.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		written, err = s.kc.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if kerrors.IsConflict(err) || kerrors.IsNotFound(err) || kerrors.IsAlreadyExists(err) {
+		return errConflict
+	} else if err != nil {
+		return apiError(err)
+	}
+	r.ResourceVersion = written.ResourceVersion
+
+	return nil
+}
+
+func (s *secretStore) DeleteMetadata(ctx context.Context, name string) error {
+	return s.deleteRecord(ctx, name)
+}
+
+func (s *secretStore) getRecord(ctx context.Context, name string) (*Record, error) {
+	secret, err := s.kc.CoreV1().Secrets(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, apiError(err)
+	}
+
+	return &Record{Name: secret.Name, Labels: secret.Labels, Data: bytesToStrings(secret.Data), ResourceVersion: secret.ResourceVersion}, nil
+}
+
+func (s *secretStore) deleteRecord(ctx context.Context, name string) error {
+	err := s.kc.CoreV1().Secrets(s.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return errRecordNotFound
+	}
+
+	return apiError(err)
+}
+
+// sectorRecordFromSecret splits the sector data from the attributes stored alongside it
+func sectorRecordFromSecret(secret *v1.Secret) *SectorRecord {
+	attributes := map[string]string{}
+	for k, v := range secret.Data {
+		if k != "sector" {
+			attributes[k] = string(v)
+		}
+	}
+	return &SectorRecord{
+		Name:            secret.Name,
+		Labels:          secret.Labels,
+		Data:            secret.Data["sector"],
+		Attributes:      attributes,
+		ResourceVersion: secret.ResourceVersion,
+	}
+}
+
+func stringsToBytes(m map[string]string) map[string][]byte {
+	b := make(map[string][]byte, len(m))
+	for k, v := range m {
+		b[k] = []byte(v)
+	}
+	return b
+}
+
+func bytesToStrings(m map[string][]byte) map[string]string {
+	s := make(map[string]string, len(m))
+	for k, v := range m {
+		s[k] = string(v)
+	}
+	return s
+}
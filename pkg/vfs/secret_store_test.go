@@ -0,0 +1,55 @@
+package vfs
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretStore(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	trackResourceVersions(kc)
+	logger := zaptest.NewLogger(t).Sugar()
+	store, err := NewStore(StorageSecret, kc, nil, testNamespace, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVFS(kc, testNamespace, logger, 2, WithSectorStore(store))
+
+	db := openTestDB(t, v, "secret.db", "_journal=DELETE")
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertRows(db, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if got := countRows(t, db); got != 100 {
+		t.Errorf("got %d rows, expected 100", got)
+	}
+
+	if n := countConfigMaps(t, kc); n != 0 {
+		t.Errorf("found %d configmaps, expected everything to be in secrets", n)
+	}
+
+	// Same names and labels as configmaps
+	f := NewFile("secret.db", v)
+	sector, err := kc.CoreV1().Secrets(testNamespace).Get(context.TODO(), f.sectorNameFromSectorIndex(0), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sector.Labels["data"] != "sector" || sector.Labels["relevant-file"] != f.fileKey() {
+		t.Errorf("sector has unexpected labels %v", sector.Labels)
+	}
+	if string(sector.Data["filename"]) != "secret.db" || len(sector.Data["sector"]) == 0 {
+		t.Error("sector secret is missing its data")
+	}
+
+	if _, err := NewStore("bucket", kc, nil, testNamespace, logger); err == nil {
+		t.Error("expected an unknown storage to be rejected")
+	}
+}
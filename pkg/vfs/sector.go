@@ -1,37 +1,62 @@
 package vfs
 
 import (
-	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultReadConcurrency is how many sectors a read fetches at once, unless WithReadConcurrency says otherwise
+const DefaultReadConcurrency = 8
 
-	"github.com/psanford/sqlite3vfs"
-	corev1 "k8s.io/api/core/v1"
-	kerrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
+var (
+	errNoSectors   = errors.New("failed to find any existing sectors")
+	errBadChecksum = errors.New("sector doesn't match its checksum")
 )
 
-var errSectorNotFound = errors.New("sector not found")
+// checksumAttribute is the CRC32C of the sector's data as stored, sectors written before checksums were added don't have one
+const checksumAttribute = "crc32c"
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func sectorChecksum(data []byte) string {
+	return strconv.FormatUint(uint64(crc32.Checksum(data, crc32c)), 16)
+}
 
 type Sector struct {
 	Index  int64
 	Data   []byte
 	Labels map[string]string
+	// ResourceVersion is the version this sector was read at, empty for new sectors.
+	// WriteSector refuses to overwrite the sector if it's changed since then.
+	ResourceVersion string
+}
+
+// sectorSize is how many bytes each of this file's sectors holds
+func (f *file) sectorSize() int64 {
+	if f.meta != nil {
+		return f.meta.SectorSize
+	}
+	return f.vfs.sectorSize
 }
 
 func (f *file) sectorForPos(pos int64) int64 {
 
-	s := (pos / SectorSize)
+	s := (pos / f.sectorSize())
 	f.vfs.logger.Debugw("sectorForPos", "pos", pos, "sector", s)
 
 	return s
 }
 
-func (f *file) deleteSector(sectorIndex int64) error {
-	n := f.sectorNameFromSectorIndex(sectorIndex)
-	err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Delete(context.TODO(), n, metav1.DeleteOptions{})
-	f.vfs.logger.Debugw("deleteSector", "sectorIndex", sectorIndex, "err", err)
+func (f *file) deleteSector(sectorName string) error {
+	if f.cached() {
+		f.vfs.cache.remove(f.fileKey(), sectorName)
+	}
+	err := f.vfs.store.DeleteSector(f.vfs.ctx, sectorName)
+	f.vfs.logger.Debugw("deleteSector", "sectorName", sectorName, "err", err)
 
 	return err
 }
@@ -39,97 +64,275 @@ func (f *file) deleteSector(sectorIndex int64) error {
 func (f *file) WriteSector(s *Sector) error {
 	f.vfs.logger.Debugw("writeSector", "sectorIndex", s.Index)
 	sectorName := f.sectorNameFromSectorIndex(s.Index)
-	cm := &corev1.ConfigMap{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "ConfigMap",
-			APIVersion: "v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      sectorName,
-			Namespace: f.vfs.namespace,
-			Labels:    f.SectorLabels,
-		},
-		BinaryData: map[string][]byte{"sector": s.Data},
-		Data:       map[string]string{"filename": f.RawName},
-	}
-	_, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
-	if kerrors.IsAlreadyExists(err) {
-		_, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	sr := &SectorRecord{
+		Name:            sectorName,
+		Labels:          f.SectorLabels,
+		Attributes:      map[string]string{"filename": f.RawName},
+		ResourceVersion: s.ResourceVersion,
+	}
+	err := f.encodeSector(s, sr)
+	if err != nil {
+		f.vfs.logger.Errorw("Failed to encode sector", "sector", sectorName, "err", err)
+		return err
+	}
+	err = f.vfs.store.PutSector(f.vfs.ctx, sr)
+	if err == errConflict {
+		if f.cached() {
+			f.vfs.cache.remove(f.fileKey(), sectorName)
+		}
+		f.vfs.logger.Errorw("Sector was changed by another writer since it was read, refusing to overwrite it", "sector", sectorName, "resourceVersion", s.ResourceVersion)
+		return err
+	} else if err != nil {
+		f.vfs.logger.Error(err)
+		return err
+	}
+	s.ResourceVersion = sr.ResourceVersion
+	if f.cached() {
+		f.vfs.cache.putSector(f.fileKey(), sr)
+	}
+	return nil
+}
+
+// encodeSector sets sr's data to s's as it should be stored, compressed then encrypted if we're doing either
+func (f *file) encodeSector(s *Sector, sr *SectorRecord) error {
+	data, compression, err := compressSector(s.Data, f.vfs.compression)
+	if err != nil {
+		return err
+	}
+	if compression != CompressionNone {
+		sr.Attributes[compressionAttribute] = string(compression)
+	}
+	if f.vfs.keyring != nil {
+		var keyID string
+		aad := sectorAAD(f.RawName, s.Index, sr.Attributes[compressionAttribute], f.vfs.keyring.current)
+		data, keyID, err = f.vfs.keyring.encrypt(data, aad)
 		if err != nil {
-			f.vfs.logger.Error(err)
 			return err
 		}
+		sr.Attributes[encryptionAttribute] = encryptionAESGCM
+		sr.Attributes[keyIDAttribute] = keyID
+	}
+	sr.Data = data
+	sr.Attributes[checksumAttribute] = sectorChecksum(data)
+
+	return nil
+}
+
+// decodeSector reverses encodeSector
+func (f *file) decodeSector(sectorIndex int64, sr *SectorRecord) ([]byte, error) {
+	if expected, ok := sr.Attributes[checksumAttribute]; ok {
+		if actual := sectorChecksum(sr.Data); actual != expected {
+			f.vfs.logger.Errorw("Sector doesn't match its checksum, it's been changed outside of the vfs or only partly restored", "sector", sr.Name, "expected", expected, "actual", actual)
+			return nil, errBadChecksum
+		}
+	}
+
+	data := sr.Data
+	encryption, encrypted := sr.Attributes[encryptionAttribute]
+	switch {
+	case encrypted && f.vfs.keyring == nil:
+		return nil, errors.New("sector is encrypted but no keys were given")
+	case encrypted && encryption != encryptionAESGCM:
+		return nil, fmt.Errorf("unknown sector encryption %q", encryption)
+	case encrypted:
+		var err error
+		keyID := sr.Attributes[keyIDAttribute]
+		data, err = f.vfs.keyring.decrypt(data, sectorAAD(f.RawName, sectorIndex, sr.Attributes[compressionAttribute], keyID), keyID)
+		if err != nil {
+			return nil, err
+		}
+	case f.vfs.keyring != nil:
+		// Otherwise anyone could replace our data with their own
+		return nil, errNotEncrypted
+	}
+
+	return decompressSector(data, Compression(sr.Attributes[compressionAttribute]), f.sectorSize())
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// dropSector makes s a hole rather than storing its zeros
+func (f *file) dropSector(s *Sector) error {
+	if s.ResourceVersion == "" {
+		// Never stored, nothing to do
 		return nil
-	} else if err != nil {
+	}
+	err := f.deleteSector(f.sectorNameFromSectorIndex(s.Index))
+	if err != nil && err != ErrSectorMissing {
 		f.vfs.logger.Error(err)
 		return err
 	}
+	s.ResourceVersion = ""
+
 	return nil
 }
 
+// putSector writes s in place, or in copy-on-write mode as a new version which isn't used until the next commit
+func (f *file) putSector(s *Sector) error {
+	if f.vfs.sparseZeros && !f.copyOnWrite() && isZero(s.Data) {
+		return f.dropSector(s)
+	}
+	if f.txn == nil || f.txn.Manifest[s.Index] == f.txn.Generation {
+		return f.WriteSector(s)
+	}
+
+	previous, hadPrevious := f.txn.Manifest[s.Index]
+	superseded := f.superseded
+	if previous != removedGeneration {
+		f.superseded = append(f.superseded, f.sectorNameFromSectorIndex(s.Index))
+	}
+	f.txn.Manifest[s.Index] = f.txn.Generation
+	s.ResourceVersion = ""
+	err := f.WriteSector(s)
+	if err == errConflict {
+		// Left behind by a writer which died before committing, nobody else can be using it
+		var sr *SectorRecord
+		sr, err = f.vfs.store.GetSector(f.vfs.ctx, f.sectorNameFromSectorIndex(s.Index))
+		if err == nil {
+			f.vfs.logger.Warnw("Replacing uncommitted sector", "sector", sr.Name)
+			s.ResourceVersion = sr.ResourceVersion
+			err = f.WriteSector(s)
+		}
+	}
+	if err != nil {
+		if hadPrevious {
+			f.txn.Manifest[s.Index] = previous
+		} else {
+			delete(f.txn.Manifest, s.Index)
+		}
+		f.superseded = superseded
+	}
+
+	return err
+}
+
 func (f *file) sectorNameFromSectorIndex(sectorIndex int64) string {
 
-	sectorName := fmt.Sprintf("%s-%d", f.b32ByteFromString(f.RawName), sectorIndex)
+	sectorName := f.sectorName(sectorIndex, f.generationOf(sectorIndex))
 	f.vfs.logger.Debugw("sectorNameFromSectorIndex", "sectorIndex", sectorIndex, "sectorName", sectorName)
 
 	return sectorName
 }
 
+// sectorName is the original name for generation 0, so files written before copy-on-write still work
+func (f *file) sectorName(sectorIndex, generation int64) string {
+	if generation == 0 {
+		return fmt.Sprintf("%s-%d", f.id, sectorIndex)
+	}
+	return fmt.Sprintf("%s-%d-%d", f.id, sectorIndex, generation)
+}
+
+// generationOf is which version of a sector we should be using, including our own uncommitted changes
+func (f *file) generationOf(sectorIndex int64) int64 {
+	if f.txn != nil {
+		return f.txn.Manifest[sectorIndex]
+	}
+	if f.meta != nil {
+		return f.meta.Manifest[sectorIndex]
+	}
+	return 0
+}
+
 func (f *file) getSector(sectorIndex int64) (*Sector, error) {
 	f.vfs.logger.Debugw("getSector", "sectorIndex", sectorIndex)
+	if s, ok := f.bufferedSector(sectorIndex); ok {
+		return s, nil
+	}
+	// Truncated away by our uncommitted transaction
+	if f.generationOf(sectorIndex) == removedGeneration {
+		return &Sector{Index: sectorIndex}, nil
+	}
 	sectorName := f.sectorNameFromSectorIndex(sectorIndex)
-	cm, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Get(context.TODO(), sectorName, metav1.GetOptions{})
+	sr, err := f.fetchSector(sectorName)
 	f.vfs.logger.Debugw("getSector", "sectorIndex", sectorIndex, "err", err)
 
-	// Make an empty sector if it doesn't exist
-	// Since we read then write
-	if kerrors.IsNotFound(err) {
-
-		err := f.WriteSector(&Sector{Index: sectorIndex})
-		if err != nil {
-			f.vfs.logger.Error(err)
-			return nil, err
-		}
-
+	// Sectors which were never written, or were all zeros, are holes which read as zeros.
+	// Nothing is stored until there's something to store.
+	if err == ErrSectorMissing {
+		return &Sector{Index: sectorIndex}, nil
 	} else if err != nil {
 		f.vfs.logger.Error(err)
-		return nil, sqlite3vfs.IOErrorShortRead
+		return nil, err
+	}
+
+	data, err := f.decodeSector(sectorIndex, sr)
+	if err != nil {
+		f.vfs.logger.Errorw("Failed to decode sector", "sector", sectorName, "err", err)
+		return nil, corrupt(err)
 	}
 
 	// Make a new function, and inverse
-	sectorData := make([]byte, SectorSize)
-	n := copy(sectorData, cm.BinaryData["sector"])
+	sectorData := make([]byte, f.sectorSize())
+	n := copy(sectorData, data)
 	sectorData = sectorData[:n]
 
 	s := Sector{
-		Index: sectorIndex,
-		Data:  sectorData,
+		Index:           sectorIndex,
+		Data:            sectorData,
+		ResourceVersion: sr.ResourceVersion,
 	}
 
 	return &s, nil
 }
 
+// fetchSector gets a sector from the read cache if we can, otherwise the store
+func (f *file) fetchSector(sectorName string) (*SectorRecord, error) {
+	if !f.cached() {
+		return f.vfs.store.GetSector(f.vfs.ctx, sectorName)
+	}
+	if sr, ok := f.vfs.cache.getSector(f.fileKey(), sectorName); ok {
+		return sr, nil
+	}
+	sr, err := f.vfs.store.GetSector(f.vfs.ctx, sectorName)
+	if err != nil {
+		return nil, err
+	}
+	f.vfs.cache.putSector(f.fileKey(), sr)
+
+	return sr, nil
+}
+
+// getLastSector finds the sector with the highest index, only needed for files from before metadata
 func (f *file) getLastSector() (*Sector, error) {
 	f.vfs.logger.Debugw("getLastSector")
 
-	cms, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labels.SelectorFromSet(f.SectorLabels).String()})
-	f.vfs.logger.Debugw("getLastSector", "f.RawName", f.RawName, "len(configmaps)", len(cms.Items), "err", err, "f.sectorLabels", f.SectorLabels)
+	sectors, err := f.vfs.store.ListSectors(f.vfs.ctx, f.SectorLabels)
+	f.vfs.logger.Debugw("getLastSector", "f.RawName", f.RawName, "len(sectors)", len(sectors), "err", err, "f.sectorLabels", f.SectorLabels)
 
 	if err != nil {
 		f.vfs.logger.Error(err)
 		return nil, err
 	}
-	if len(cms.Items) == 0 {
-		f.vfs.logger.Debugw("getLastSector failed to find any sectors", "f", f, "cms", cms)
-		return nil, errors.New("failed to find any existing sectors")
 
+	// Sparse files have holes, so the count of sectors doesn't say where the end is
+	sectorIndex := int64(-1)
+	prefix := f.id + "-"
+	for _, sr := range sectors {
+		index, err := strconv.ParseInt(strings.TrimPrefix(sr.Name, prefix), 10, 64)
+		if err != nil {
+			// Not a generation 0 sector, which is all older files have
+			continue
+		}
+		if index > sectorIndex {
+			sectorIndex = index
+		}
 	}
+	if sectorIndex < 0 {
+		f.vfs.logger.Debugw("getLastSector failed to find any sectors", "f", f)
+		return nil, errNoSectors
 
-	sectorIndex := len(cms.Items) - 1
+	}
 
 	f.vfs.logger.Debugw("getLastSector", "sectorIndex", sectorIndex)
 
-	return f.getSector(int64(sectorIndex))
+	return f.getSector(sectorIndex)
 
 }
 
@@ -138,7 +341,7 @@ func (f *file) getSectorRange(firstSector, lastSector int64) ([]*Sector, error)
 
 	if firstSector == lastSector {
 		sect, err := f.getSector(firstSector)
-		if err == errSectorNotFound {
+		if err == ErrSectorMissing {
 			return nil, nil
 		} else if err != nil {
 			return nil, err
@@ -147,14 +350,49 @@ func (f *file) getSectorRange(firstSector, lastSector int64) ([]*Sector, error)
 	}
 	sectors := make([]*Sector, ((lastSector - firstSector) + 1)) // +1 because 0 indexes
 
+	workers := f.vfs.readConcurrency
+	if workers > len(sectors) {
+		workers = len(sectors)
+	}
+	if workers <= 1 {
+		for i := firstSector; i <= lastSector; i++ {
+			thisSector, err := f.getSector(i)
+			if err != nil {
+				f.vfs.logger.Error(err)
+				return nil, err
+			}
+			sectors[i-firstSector] = thisSector
+
+		}
+		return sectors, nil
+	}
+
+	// Every sector is a round trip, so fetch several at once and long reads take about as long as short ones
+	indexes := make(chan int64)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range indexes {
+				if errs[w] == nil {
+					sectors[i-firstSector], errs[w] = f.getSector(i)
+				}
+			}
+		}(w)
+	}
 	for i := firstSector; i <= lastSector; i++ {
-		thisSector, err := f.getSector(i)
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
 		if err != nil {
 			f.vfs.logger.Error(err)
-			return nil, sqlite3vfs.IOErrorRead
+			return nil, err
 		}
-		sectors[i-firstSector] = thisSector
-
 	}
 
 	return sectors, nil
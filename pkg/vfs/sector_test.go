@@ -0,0 +1,309 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWriteSectorConflict(t *testing.T) {
+	v, _ := newTestVFS(t)
+	f1 := openTestFile(t, v, "conflict.db")
+	f2 := openTestFile(t, v, "conflict.db")
+
+	stale, err := f1.getSector(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f2.WriteAt([]byte("from f2"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.Data = []byte("from f1")
+	if err := f1.WriteSector(stale); err != errConflict {
+		t.Errorf("writing a stale sector returned %v, expected a conflict", err)
+	}
+
+	got := make([]byte, 7)
+	if _, err := f1.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "from f2" {
+		t.Errorf("stale write overwrote the sector, got %q", got)
+	}
+
+	// New sectors mustn't replace one someone else created
+	if err := f1.WriteSector(&Sector{Index: 0, Data: []byte("new")}); err != errConflict {
+		t.Errorf("creating an existing sector returned %v, expected a conflict", err)
+	}
+
+	// A fresh read can be written back, and the version is updated for the next write
+	fresh, err := f1.getSector(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh.Data = []byte("from f1")
+	if err := f1.WriteSector(fresh); err != nil {
+		t.Fatal(err)
+	}
+	fresh.Data = []byte("again!!")
+	if err := f1.WriteSector(fresh); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteAtConflictIsIOError(t *testing.T) {
+	v, kc := newTestVFS(t)
+	f := openTestFile(t, v, "ioerr.db")
+
+	_, err := f.WriteAt([]byte("first"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer sneaks in between our read and write of the sector
+	raced := false
+	kc.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		cm := action.(k8stesting.UpdateAction).GetObject().(*v1.ConfigMap)
+		if !raced && cm.Name == f.sectorNameFromSectorIndex(0) {
+			raced = true
+			other := cm.DeepCopy()
+			other.BinaryData["sector"] = []byte("other")
+			other.ResourceVersion = "raced"
+			if err := kc.Tracker().Update(action.GetResource(), other, action.GetNamespace()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return false, nil, nil
+	})
+
+	_, err = f.WriteAt([]byte("mine"), 0)
+	if err != sqlite3vfs.IOErrorWrite {
+		t.Errorf("WriteAt racing another writer returned %v, expected %v", err, sqlite3vfs.IOErrorWrite)
+	}
+}
+
+func TestSectorSize(t *testing.T) {
+	const sectorSize = 256 * 1024
+	v, kc := newTestVFS(t, WithSectorSize(sectorSize))
+	f := openTestFile(t, v, "big.db")
+
+	data := randomBytes(t, 4*sectorSize+10)
+	_, err := f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := randomBytes(t, SectorSize)
+	_, err = f.WriteAt(patch, sectorSize-100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[sectorSize-100:], patch)
+
+	// 5 sectors, metadata and the lockfile
+	if got := countConfigMaps(t, kc); got != 7 {
+		t.Errorf("got %d configmaps, expected 7", got)
+	}
+	r, err := v.store.GetMetadata(context.TODO(), f.MetadataName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Data["sectorSize"] != "262144" || r.Data["version"] != "3" {
+		t.Errorf("unexpected metadata %v", r.Data)
+	}
+
+	// The file keeps its sector size when opened with a different default
+	other := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2)
+	g := openTestFile(t, other, "big.db")
+	got := make([]byte, len(data))
+	_, err = g.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAt with a different default sector size didn't match")
+	}
+
+	err = g.Truncate(sectorSize + 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countConfigMaps(t, kc); got != 4 {
+		t.Errorf("got %d configmaps after Truncate, expected 4", got)
+	}
+	got = make([]byte, sectorSize+20)
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[:sectorSize+20]) {
+		t.Error("data before the truncation point changed")
+	}
+
+	// New files use the default
+	if s := openTestFile(t, other, "small.db").SectorSize(); s != SectorSize {
+		t.Errorf("new file has sector size %d, expected %d", s, SectorSize)
+	}
+}
+
+func TestSectorChecksum(t *testing.T) {
+	v, kc := newTestVFS(t)
+	f := openTestFile(t, v, "checksum.db")
+	_, err := f.WriteAt([]byte("checked"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := v.store.GetSector(context.TODO(), f.sectorNameFromSectorIndex(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Attributes[checksumAttribute] != sectorChecksum([]byte("checked")) {
+		t.Errorf("sector has checksum %q", sr.Attributes[checksumAttribute])
+	}
+
+	// Someone edits the configmap by hand
+	cm, err := kc.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), sr.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.BinaryData["sector"] = []byte("changed")
+	cm, err = kc.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(make([]byte, 7), 0); err != sqlite3vfs.IOErrorRead {
+		t.Errorf("reading a corrupt sector returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+	}
+
+	// Sectors from before checksums are trusted
+	delete(cm.Data, checksumAttribute)
+	_, err = kc.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 7)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "changed" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSparseFile(t *testing.T) {
+	v, kc := newTestVFS(t, WithSparseZeros())
+	f := openTestFile(t, v, "sparse.db")
+
+	_, err := f.WriteAt([]byte("tail"), 5*SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One sector, metadata and the lockfile
+	if got := countConfigMaps(t, kc); got != 3 {
+		t.Errorf("got %d configmaps, expected 3", got)
+	}
+
+	// Reading the holes doesn't write anything
+	writes := countWrites(kc)
+	expected := make([]byte, 5*SectorSize+4)
+	copy(expected[5*SectorSize:], "tail")
+	if got := readAll(t, f); !bytes.Equal(got, expected) {
+		t.Error("holes didn't read as zeros")
+	}
+	if n := writes.Load(); n != 0 {
+		t.Errorf("reading made %d writes", n)
+	}
+
+	// Zeroing a sector deletes it
+	_, err = f.WriteAt(randomBytes(t, SectorSize), SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countConfigMaps(t, kc); got != 4 {
+		t.Errorf("got %d configmaps after filling in a hole, expected 4", got)
+	}
+	_, err = f.WriteAt(make([]byte, SectorSize), SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countConfigMaps(t, kc); got != 3 {
+		t.Errorf("got %d configmaps after zeroing a sector, expected 3", got)
+	}
+	if got := readAll(t, f); !bytes.Equal(got, expected) {
+		t.Error("zeroed sector didn't read as zeros")
+	}
+
+	// Files from before metadata get their size from the last sector, not the number of them
+	if err := f.deleteMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	g := openTestFile(t, v, "sparse.db")
+	if size, err := g.FileSize(); err != nil || size != int64(len(expected)) {
+		t.Errorf("rebuilt size is %d, %v, expected %d", size, err, len(expected))
+	}
+}
+
+// slowStore takes a while to answer sector reads, and remembers how many it answered at once
+type slowStore struct {
+	SectorStore
+	mu       sync.Mutex
+	inFlight int
+	most     int
+}
+
+func (s *slowStore) GetSector(ctx context.Context, name string) (*SectorRecord, error) {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.most {
+		s.most = s.inFlight
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	return s.SectorStore.GetSector(ctx, name)
+}
+
+func TestReadConcurrency(t *testing.T) {
+	const sectorSize = 1024
+	for _, concurrency := range []int{1, 4} {
+		kc := fake.NewSimpleClientset()
+		trackResourceVersions(kc)
+		logger := zaptest.NewLogger(t).Sugar()
+		store := &slowStore{SectorStore: NewConfigMapStore(kc, testNamespace, logger)}
+		v := NewVFS(kc, testNamespace, logger, 2, WithSectorStore(store), WithSectorSize(sectorSize), WithReadConcurrency(concurrency))
+		f := openTestFile(t, v, "parallel.db")
+
+		data := randomBytes(t, 10*sectorSize)
+		if _, err := f.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		store.most = 0
+		got := make([]byte, len(data))
+		if _, err := f.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("read with concurrency %d didn't match what was written", concurrency)
+		}
+		if store.most != concurrency {
+			t.Errorf("fetched %d sectors at once, expected %d", store.most, concurrency)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	errRecordNotFound = errors.New("record not found")
+	errConflict       = errors.New("object was changed by someone else")
+)
+
+// SectorRecord is a single stored sector
+type SectorRecord struct {
+	Name   string
+	Labels map[string]string
+	Data   []byte
+	// Attributes are small string values stored alongside the data, such as the filename
+	Attributes map[string]string
+	// ResourceVersion is set by Get and Put, and passed back to PutSector for optimistic concurrency
+	ResourceVersion string
+}
+
+// Record is a small key/value object, used for lock files and file metadata
+type Record struct {
+	Name   string
+	Labels map[string]string
+	Data   map[string]string
+	// ResourceVersion is set by Get, and passed back to PutLock or PutMetadata for optimistic concurrency
+	ResourceVersion string
+}
+
+// SectorStore is the storage backend for the vfs.
+// Get and Delete calls return ErrSectorMissing or errRecordNotFound if the object doesn't exist.
+// Errors which mean the API server couldn't answer should match ErrAPIUnavailable.
+type SectorStore interface {
+	// Ping checks that the backend is reachable
+	Ping(ctx context.Context) error
+
+	GetSector(ctx context.Context, name string) (*SectorRecord, error)
+	// PutSector creates the sector if s.ResourceVersion is empty, otherwise updates it only if it's unchanged since that version.
+	// Returns errConflict if either isn't possible, and sets s.ResourceVersion to the new version on success.
+	PutSector(ctx context.Context, s *SectorRecord) error
+	DeleteSector(ctx context.Context, name string) error
+	// ListSectors returns every sector with all of the given labels
+	ListSectors(ctx context.Context, labels map[string]string) ([]*SectorRecord, error)
+
+	GetLock(ctx context.Context, name string) (*Record, error)
+	// PutLock creates the lockfile if r.ResourceVersion is empty, otherwise updates it only if it's unchanged since that version.
+	// Returns errConflict if either isn't possible.
+	PutLock(ctx context.Context, r *Record) error
+	DeleteLock(ctx context.Context, name string) error
+
+	GetMetadata(ctx context.Context, name string) (*Record, error)
+	// PutMetadata creates the object if r.ResourceVersion is empty, otherwise updates it only if it's unchanged since that version.
+	// Returns errConflict if either isn't possible, and sets r.ResourceVersion to the new version on success.
+	PutMetadata(ctx context.Context, r *Record) error
+	DeleteMetadata(ctx context.Context, name string) error
+}
+
+// SectorWatcher is implemented by stores which can tell us when sectors change, to keep the read cache tidy
+type SectorWatcher interface {
+	// WatchSectors calls changed for every sector with all of the given labels which is created, updated or deleted,
+	// until ctx is done or the watch ends
+	WatchSectors(ctx context.Context, labels map[string]string, changed func(sr *SectorRecord, deleted bool)) error
+}
+
+// Storage names a built in backend, so it can be picked on the command line
+type Storage string
+
+const (
+	StorageConfigMap Storage = "configmap"
+	StorageSecret    Storage = "secret"
+	StorageCRD       Storage = "crd"
+)
+
+// NewStore creates the built in backend called storage.
+// dc is only needed for StorageCRD.
+func NewStore(storage Storage, kc kubernetes.Interface, dc dynamic.Interface, namespace string, logger *zap.SugaredLogger) (SectorStore, error) {
+	switch storage {
+	case StorageConfigMap:
+		return NewConfigMapStore(kc, namespace, logger), nil
+	case StorageSecret:
+		return NewSecretStore(kc, namespace, logger), nil
+	case StorageCRD:
+		if dc == nil {
+			return nil, errors.New("crd storage needs a dynamic client")
+		}
+		return NewCRDStore(dc, kc, namespace, logger), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", storage)
+}
+
+// The discovery client doesn't take a context, so these make the same requests with one.
+// Clients without a RESTClient, like the fake clientset, are called in the background instead,
+// and left to finish on their own if ctx is done first.
+
+// serverVersion checks the API server is answering
+func serverVersion(ctx context.Context, d discovery.DiscoveryInterface) error {
+	if rc := d.RESTClient(); rc != nil {
+		return rc.Get().AbsPath("/version").Do(ctx).Error()
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.ServerVersion()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serverResources lists the resources of a group version
+func serverResources(ctx context.Context, d discovery.DiscoveryInterface, groupVersion string) (*metav1.APIResourceList, error) {
+	if rc := d.RESTClient(); rc != nil {
+		raw, err := rc.Get().AbsPath("/apis", groupVersion).Do(ctx).Raw()
+		if err != nil {
+			return nil, err
+		}
+		resources := &metav1.APIResourceList{}
+		return resources, json.Unmarshal(raw, resources)
+	}
+	type result struct {
+		resources *metav1.APIResourceList
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resources, err := d.ServerResourcesForGroupVersion(groupVersion)
+		done <- result{resources, err}
+	}()
+	select {
+	case r := <-done:
+		return r.resources, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,137 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// hangingStore is an API server which stops answering sector reads when hang is set
+type hangingStore struct {
+	SectorStore
+	hang atomic.Bool
+}
+
+func (s *hangingStore) GetSector(ctx context.Context, name string) (*SectorRecord, error) {
+	if s.hang.Load() {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return s.SectorStore.GetSector(ctx, name)
+}
+
+func TestOpTimeout(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	trackResourceVersions(kc)
+	logger := zaptest.NewLogger(t).Sugar()
+	store := &hangingStore{SectorStore: NewConfigMapStore(kc, testNamespace, logger)}
+	v := NewVFS(kc, testNamespace, logger, 2, WithSectorStore(store), WithOpTimeout(50*time.Millisecond))
+	f := openTestFile(t, v, "hung.db")
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	store.hang.Store(true)
+	start := time.Now()
+	if _, err := f.ReadAt(make([]byte, 4), 0); err != sqlite3vfs.IOErrorRead {
+		t.Errorf("ReadAt returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+	}
+	if _, err := f.WriteAt([]byte("more"), 2); err != sqlite3vfs.IOErrorRead {
+		t.Errorf("WriteAt returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("hung reads took %s to fail", took)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	trackResourceVersions(kc)
+	logger := zaptest.NewLogger(t).Sugar()
+	store := &hangingStore{SectorStore: NewConfigMapStore(kc, testNamespace, logger)}
+	ctx, cancel := context.WithCancel(context.Background())
+	v := NewVFS(kc, testNamespace, logger, 2, WithSectorStore(store), WithContext(ctx), WithOpTimeout(0))
+	f := openTestFile(t, v, "cancelled.db")
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// No timeout, so only cancelling stops the hung read
+	store.hang.Store(true)
+	done := make(chan error)
+	go func() {
+		_, err := f.ReadAt(make([]byte, 4), 0)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != sqlite3vfs.IOErrorRead {
+			t.Errorf("ReadAt returned %v, expected %v", err, sqlite3vfs.IOErrorRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelling the context didn't stop the read")
+	}
+
+	if _, _, err := v.Open("cancelled.db", sqlite3vfs.OpenMainDB); err != sqlite3vfs.IOError {
+		t.Errorf("Open after cancelling returned %v, expected %v", err, sqlite3vfs.IOError)
+	}
+}
+
+// Open pings the API server first, which has to give up too
+func TestOpenTimeout(t *testing.T) {
+	// An API server which never answers
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	hung, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake clientset's discovery doesn't take a context at all
+	faked := fake.NewSimpleClientset()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	faked.PrependReactor("get", "version", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		<-unblock
+		return false, nil, nil
+	})
+
+	for name, kc := range map[string]kubernetes.Interface{"client": hung, "fake": faked} {
+		t.Run(name, func(t *testing.T) {
+			v := NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 0, WithOpTimeout(100*time.Millisecond))
+			if err := v.store.Ping(context.TODO()); !errors.Is(err, ErrAPIUnavailable) {
+				t.Errorf("Ping returned %v, expected %v", err, ErrAPIUnavailable)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := v.Open("hung.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != sqlite3vfs.IOError {
+					t.Errorf("Open returned %v, expected %v", err, sqlite3vfs.IOError)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Open didn't give up on a hung API server")
+			}
+		})
+	}
+}
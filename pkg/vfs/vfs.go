@@ -2,41 +2,265 @@ package vfs
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base32"
-	"errors"
-	"fmt"
 	"io"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/psanford/sqlite3vfs"
 	"go.uber.org/zap"
-	v1 "k8s.io/api/core/v1"
-	kerrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
-	LockFileNameSuffix = "lockfile"
-	SectorSize         = 64 * 1024 // Max pagesize supported by SQLITE3
+	LockFileNameSuffix    = "lockfile"
+	LeaseNameSuffix       = "lease"
+	MetadataNameSuffix    = "metadata"
+	MetadataFormatVersion = 3          // The newest format we can read
+	SectorSize            = 64 * 1024  // Max pagesize supported by SQLITE3, and the default sector size
+	MaxSectorSize         = 900 * 1024 // Leaves room for everything else in a 1MiB object
+	maxLabelLength        = 63
+	hashedIDBytes         = 20 // 160 bits of SHA-256, 32 characters of base32
 )
 
 // Only var because this can't be a const
 var (
 	CommonSectorLabel = map[string]string{"data": "sector"}
 	LockfileLabel     = map[string]string{"data": "lockfile"}
+	MetadataLabel     = map[string]string{"data": "metadata"}
+	LeaseLabel        = map[string]string{"data": "lease"}
 )
 
 type vfs struct {
-	kc        *kubernetes.Clientset
-	logger    *zap.SugaredLogger
-	retries   int
+	store  SectorStore
+	logger *zap.SugaredLogger
+	// retry is used for every call to the store, and for loops which re-read something that changed under them
+	retry RetryPolicy
+	// holderIdentity is who we are in lockfiles
+	holderIdentity string
+	lockTTL        time.Duration
+	nextHandle     uint64
+	// copyOnWrite writes changed sectors under new names, only switching to them on Sync
+	copyOnWrite bool
+	// writeBufferSectors is how many changed sectors each file keeps in memory until Sync, 0 writes them straight away
+	writeBufferSectors int
+	readCacheSectors   int
+	cache              *sectorCache
+	// sectorSize is used for new files, existing files keep the one they were created with
+	sectorSize  int64
+	compression Compression
+	keyring     *Keyring
+	// sparseZeros deletes sectors which are all zeros rather than storing them
+	sparseZeros bool
+	// ctx is the parent of every call to the store, which each get opTimeout
+	ctx       context.Context
+	opTimeout time.Duration
+	rateLimit RateLimit
+	// readConcurrency is how many sectors a read can fetch at once
+	readConcurrency int
+	// readAhead is how many sectors to fetch ahead of sequential reads
+	readAhead int
+	// wal lets main databases use WAL mode, with the wal-index in this process's memory
+	wal       bool
 	namespace string
+	// exclusive holds a Lease on each open database and keeps its locks in memory, see WithExclusiveProcess
+	exclusive bool
+	kc        kubernetes.Interface
+	api       *apiStore
+	leaseMu   sync.Mutex
+	leases    map[string]*lease
 }
 
-func NewVFS(kc *kubernetes.Clientset, namespace string, logger *zap.SugaredLogger, retries int) *vfs {
-	return &vfs{kc: kc, logger: logger, retries: retries, namespace: namespace}
+// Option configures optional behaviour of the vfs
+type Option func(*vfs)
+
+// WithSectorStore replaces the default ConfigMap storage with another backend
+func WithSectorStore(store SectorStore) Option {
+	return func(v *vfs) {
+		v.store = store
+	}
+}
+
+// WithHolderIdentity sets the name this vfs uses when holding locks, such as the pod name.
+// It must be unique across everything sharing the files.
+func WithHolderIdentity(id string) Option {
+	return func(v *vfs) {
+		v.holderIdentity = id
+	}
+}
+
+// WithLockTTL sets how long locks last if whoever holds them stops renewing them, at least MinLockTTL
+func WithLockTTL(ttl time.Duration) Option {
+	return func(v *vfs) {
+		v.lockTTL = ttl
+	}
+}
+
+// WithCopyOnWrite makes all of the writes between two Syncs appear at once, by writing changed sectors
+// under new names and switching the file over to them with a single metadata update.
+// Nothing else sees a half written file, at the cost of an extra write per sector changed.
+func WithCopyOnWrite() Option {
+	return func(v *vfs) {
+		v.copyOnWrite = true
+	}
+}
+
+// WithWriteBuffer keeps up to sectors changed sectors per file in memory, writing them out on Sync
+// (or when the buffer is full) rather than on every WriteAt. SQLite often writes the same page several
+// times in a transaction, so this saves a lot of API calls.
+func WithWriteBuffer(sectors int) Option {
+	return func(v *vfs) {
+		v.writeBufferSectors = sectors
+	}
+}
+
+// WithReadCache keeps up to sectors recently used sectors of main database files in memory,
+// so repeated reads don't have to go back to the API server
+func WithReadCache(sectors int) Option {
+	return func(v *vfs) {
+		v.readCacheSectors = sectors
+	}
+}
+
+// WithSectorSize sets how many bytes each sector of newly created files holds, up to MaxSectorSize.
+// Bigger sectors mean fewer objects and API calls for large databases, but every write of a page
+// rewrites its whole sector. Sizes which are a multiple of SectorSize keep 64KiB pages atomic.
+func WithSectorSize(size int64) Option {
+	return func(v *vfs) {
+		v.sectorSize = size
+	}
+}
+
+// WithCompression compresses sectors before storing them. SQLite pages are often mostly zeros or text,
+// so this fits bigger databases in the same number of objects and sends less to the API server.
+// Sectors which don't get any smaller are stored uncompressed.
+func WithCompression(c Compression) Option {
+	return func(v *vfs) {
+		v.compression = c
+	}
+}
+
+// WithEncryption encrypts every sector with AES-256-GCM before storing it, so the data can't be read
+// (or changed without us noticing) by anyone with access to the cluster but not the keys.
+// Sectors which aren't encrypted are refused, so files have to be written with encryption on from the start.
+func WithEncryption(keys *Keyring) Option {
+	return func(v *vfs) {
+		v.keyring = keys
+	}
+}
+
+// WithSparseZeros doesn't store sectors which are all zeros, deleting them instead, as missing sectors read as zeros.
+// Freshly allocated and freed pages cost nothing, at the cost of not noticing someone else changed a sector we're zeroing.
+// It has no effect in copy-on-write mode.
+func WithSparseZeros() Option {
+	return func(v *vfs) {
+		v.sparseZeros = true
+	}
+}
+
+// WithContext sets a context for everything the vfs does, cancelling it fails anything in progress
+// and stops the background lock renewals and watches
+func WithContext(ctx context.Context) Option {
+	return func(v *vfs) {
+		v.ctx = ctx
+	}
+}
+
+// WithOpTimeout sets how long each call to the API server can take before SQLite gets an I/O error,
+// so a hung API server can't block a query forever. 0 means no limit.
+func WithOpTimeout(timeout time.Duration) Option {
+	return func(v *vfs) {
+		v.opTimeout = timeout
+	}
+}
+
+// WithRetryPolicy replaces the default retry policy, including the retries given to NewVFS
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(v *vfs) {
+		v.retry = p
+	}
+}
+
+// WithRateLimit limits how fast the vfs calls the API server, so busy databases don't get everyone throttled
+func WithRateLimit(l RateLimit) Option {
+	return func(v *vfs) {
+		v.rateLimit = l
+	}
+}
+
+// WithReadConcurrency sets how many sectors a single read fetches at once, 1 fetches them one after another
+func WithReadConcurrency(n int) Option {
+	return func(v *vfs) {
+		v.readConcurrency = n
+	}
+}
+
+// WithReadAhead fetches up to n sectors ahead of sequential reads, such as table scans, into the read cache.
+// It needs WithReadCache.
+func WithReadAhead(n int) Option {
+	return func(v *vfs) {
+		v.readAhead = n
+	}
+}
+
+// WithWAL allows journal_mode=WAL, so readers don't wait for writers.
+// The wal-index is only shared within this process, so every connection to the database must be in it.
+func WithWAL() Option {
+	return func(v *vfs) {
+		v.wal = true
+	}
+}
+
+// WithExclusiveProcess is for databases which only this process uses.
+// Opening a database takes a Lease on it, renewed in the background, and its locks are then only kept in memory,
+// saving the lockfile API calls on every transaction. Every other process using the database must use it too.
+// Once the Lease is lost everything done with the database fails, with ErrLeaseLost.
+func WithExclusiveProcess() Option {
+	return func(v *vfs) {
+		v.exclusive = true
+	}
+}
+
+// NewVFS creates a vfs storing files in the given namespace.
+// kc can be any kubernetes.Interface, such as the fake clientset.
+func NewVFS(kc kubernetes.Interface, namespace string, logger *zap.SugaredLogger, retries int, opts ...Option) *vfs {
+	retry := DefaultRetryPolicy
+	retry.Retries = retries
+	v := &vfs{ctx: context.Background(), namespace: namespace, kc: kc, leases: map[string]*lease{}, logger: logger, retry: retry, holderIdentity: uuid.NewString(), lockTTL: DefaultLockTTL, opTimeout: DefaultOpTimeout, sectorSize: SectorSize, readConcurrency: DefaultReadConcurrency}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if v.sectorSize <= 0 || v.sectorSize > MaxSectorSize {
+		logger.Warnw("Invalid sector size, using the default", "sectorSize", v.sectorSize, "default", SectorSize)
+		v.sectorSize = SectorSize
+	}
+	if v.lockTTL < MinLockTTL {
+		logger.Warnw("Invalid lock TTL, using the default", "lockTTL", v.lockTTL, "default", DefaultLockTTL)
+		v.lockTTL = DefaultLockTTL
+	}
+	if v.store == nil {
+		v.store = NewConfigMapStore(kc, namespace, logger)
+	}
+	if v.wal && v.readCacheSectors > 0 {
+		// Checkpoints write the database while everyone holds SHARED, which is what the cache relies on not happening
+		logger.Warnw("The read cache can't be used with WAL mode, turning it off", "readCacheSectors", v.readCacheSectors)
+		v.readCacheSectors = 0
+	}
+	if v.readCacheSectors > 0 {
+		v.cache = newSectorCache(v.readCacheSectors, logger)
+		if w, ok := v.store.(SectorWatcher); ok {
+			go v.cache.watch(v.ctx, w)
+		}
+	}
+	if v.retry.Retries < 0 {
+		v.retry.Retries = 0
+	}
+	v.api = &apiStore{store: v.store, timeout: v.opTimeout, retry: v.retry, limit: v.rateLimit, limiter: v.rateLimit.limiter(), logger: logger}
+	v.store = v.api
+	return v
 }
 
 func (f *file) b32ByteFromString(s string) []byte {
@@ -46,16 +270,67 @@ func (f *file) b32ByteFromString(s string) []byte {
 	return dst
 }
 
+// fileID is what the file's objects are named after, and its relevant-file label.
+// It's the base32 of the name if that fits in a label, otherwise a hash of the name.
+// Hashes start with z, which base32 never uses, so they can't clash.
+func (f *file) fileID() string {
+	id := string(f.b32ByteFromString(f.RawName))
+	if len(id) <= maxLabelLength {
+		return id
+	}
+	sum := sha256.Sum256([]byte(f.RawName))
+	return "z" + string(f.b32ByteFromString(string(sum[:hashedIDBytes])))
+}
+
 func (f *file) Close() error {
+	return sqliteError(f.close(), sqlite3vfs.IOError)
+}
 
-	err := f.setLock(sqlite3vfs.LockNone)
+func (f *file) close() error {
+	// Even if we can't write everything out, let the lease go rather than holding the database forever
+	if f.lease != nil {
+		defer func() {
+			f.vfs.releaseLease(f.lease)
+			f.lease = nil
+		}()
+	}
+
+	// Files without locks, like journals, never get an Unlock to commit them
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	err = f.commit()
+	if err != nil {
+		return err
+	}
+
+	err = f.unlock(sqlite3vfs.LockNone)
+
+	// Even if we couldn't unlock, stop renewing so our locks expire
+	f.lockMu.Lock()
+	f.setLockLevel(sqlite3vfs.LockNone)
+	f.lockMu.Unlock()
 
 	return err
 }
 
+// Truncate shrinks the file to size, growing it is left to WriteAt
 func (f *file) Truncate(size int64) error {
+	return sqliteError(f.truncate(size), sqlite3vfs.IOError)
+}
+
+func (f *file) truncate(size int64) error {
+	if err := f.checkLock(); err != nil {
+		return err
+	}
 
-	fileSize, err := f.FileSize()
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+
+	fileSize, err := f.fileSize()
 	if err != nil {
 		return err
 	}
@@ -64,59 +339,140 @@ func (f *file) Truncate(size int64) error {
 		return nil
 	}
 
-	lastRemainingSector := f.sectorForPos(size)
-
-	sect, err := f.getSector(lastRemainingSector)
-	if err != nil {
-		return err
+	// Work out what's going before the size changes, as the names of sectors come from the metadata
+	lastSector := f.sectorForPos(fileSize - 1)
+	toDelete := []string{}
+	for sectToDelete := sectorsForSize(size, f.sectorSize()); sectToDelete <= lastSector; sectToDelete += 1 {
+		toDelete = append(toDelete, f.sectorNameFromSectorIndex(sectToDelete))
 	}
 
-	sect.Data = sect.Data[:size%SectorSize]
+	if f.copyOnWrite() {
+		err = f.beginTxn()
+		if err != nil {
+			return err
+		}
+		// Still needed until the truncation is committed
+		for sectToDelete := sectorsForSize(size, f.sectorSize()); sectToDelete <= lastSector; sectToDelete += 1 {
+			f.txn.Manifest[sectToDelete] = removedGeneration
+		}
+		f.superseded = append(f.superseded, toDelete...)
+		toDelete = nil
+	} else {
+		// Change the size first, so a crash part way through leaves the file at its new size
+		// Important for journal_mode=TRUNCATE where this is the commit
+		err = f.setSize(size)
+		if err != nil {
+			return err
+		}
+	}
 
-	f.WriteSector(sect)
+	// Only keep the last sector if some of its data survives
+	if keep := size % f.sectorSize(); keep != 0 {
+		sect, err := f.getSector(f.sectorForPos(size))
+		if err != nil {
+			return err
+		}
 
-	lastSector := f.sectorForPos(fileSize)
+		if int64(len(sect.Data)) > keep {
+			sect.Data = sect.Data[:keep]
+		}
 
-	for sectToDelete := lastRemainingSector; sectToDelete <= lastSector; sectToDelete += 1 {
-		err := f.deleteSector(sectToDelete)
+		err = f.putSector(sect)
 		if err != nil {
 			return err
 		}
 	}
 
+	if f.txn != nil {
+		f.txn.resize(size)
+	}
+
+	for _, sectorName := range toDelete {
+		err := f.deleteSector(sectorName)
+		if err != nil && err != ErrSectorMissing {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (f *file) FileSize() (int64, error) {
+	size, err := f.fileSize()
+	return size, sqliteError(err, sqlite3vfs.IOError)
+}
+
+func (f *file) fileSize() (int64, error) {
 	f.vfs.logger.Debugw("FileSize", "f", f)
-	lastcm, err := f.getLastSector()
+	if err := f.checkLease(); err != nil {
+		return 0, err
+	}
+	// Our own writes which haven't been committed yet
+	if f.txn != nil {
+		return f.txn.Size, nil
+	}
+	if f.buffering {
+		return f.bufferedSize, nil
+	}
+	m, err := f.getMetadata()
 	if err != nil {
 		f.vfs.logger.Error(err)
 
 		return 0, err
 	}
-	// Could have an off by one error
-	size := lastcm.Index*f.SectorSize() + int64(len(lastcm.Data))
-	f.vfs.logger.Debugw("FileSize", "f", f, "size", size)
+	f.vfs.logger.Debugw("FileSize", "f", f, "size", m.Size)
 
-	return size, nil
+	return m.Size, nil
 
 }
 
 type file struct {
-	RawName      string
+	RawName string
+	// id names all of the file's objects, see fileID
+	id           string
 	vfs          *vfs
 	encoding     *base32.Encoding
 	SectorLabels map[string]string
+	// handle identifies this open file within the vfs's locks
+	handle    uint64
+	lockMu    sync.Mutex
+	lockLevel sqlite3vfs.LockType
+	stopRenew chan struct{}
+	// lockExpires is when our locks expire as of their last renewal, in unix nanoseconds, or 0 without any.
+	// lockLost is set once they could have expired, until we lock again from NONE.
+	lockExpires atomic.Int64
+	lockLost    atomic.Bool
+	// mainDB files are the ones SQLite locks, so they can use the read cache
+	mainDB bool
+	// walFile is a -wal file, which every connection reads straight from the store
+	walFile bool
+	// meta is the metadata as of the last time we read or wrote it
+	meta *fileMetadata
+	// dirty are sectors changed since the last flush, and bufferedSize is the size the file will be after it
+	buffering    bool
+	dirty        map[int64]*Sector
+	bufferedSize int64
+	// txn is the metadata to be committed in copy-on-write mode, nil if nothing has changed.
+	// superseded are the sectors which can be deleted once it is.
+	txn        *fileMetadata
+	superseded []string
+	ahead      readAhead
+	// lease is held on main databases in exclusive process mode
+	lease *lease
 }
 
 // this needs to return Eof if a read is attempted off the end of the file...
 func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.readAt(p, off)
+	return n, sqliteError(err, sqlite3vfs.IOErrorRead)
+}
+
+func (f *file) readAt(p []byte, off int64) (int, error) {
 	f.vfs.logger.Debugw("ReadAt", "f", f, "off", off, "len(buffer)", len(p))
 
 	firstSector := f.sectorForPos(off)
 
-	fileSize, err := f.FileSize()
+	fileSize, err := f.fileSize()
 	if err != nil {
 		f.vfs.logger.Debugw("ReadAt", "off", off, "len(buffer)", len(p), "fileSize", fileSize, "err", err)
 
@@ -139,25 +495,33 @@ func (f *file) ReadAt(p []byte, off int64) (int, error) {
 	}
 
 	var (
-		n     int
-		first = true
+		n          int
+		first      = true
+		sectorSize = f.sectorSize()
 	)
 	sectors, err := f.getSectorRange(firstSector, lastSector)
 	if err != nil {
-		return 0, sqlite3vfs.IOErrorRead
+		return 0, err
 	}
+	f.readingAhead(firstSector, lastSector, fileSize)
 	for _, sect := range sectors {
+		// Sectors before the end can be short after a truncate, the rest of them reads as zeros
+		sectorData := make([]byte, sectorSize)
+		copy(sectorData, sect.Data)
 		if first {
-			startIndex := off % SectorSize
-			n = copy(p, sect.Data[startIndex:])
+			startIndex := off % sectorSize
+			n = copy(p, sectorData[startIndex:])
 			first = false
 			continue
 		}
 
-		nn := copy(p[n:], sect.Data)
+		nn := copy(p[n:], sectorData)
 		n += nn
 	}
 	if lastByte >= fileSize {
+		if remaining := int(fileSize - off); n > remaining {
+			n = remaining
+		}
 		return n, io.EOF
 	}
 	f.vfs.logger.Debugw("ReadAt", "off", off, "len(buffer)", len(p), "n", n)
@@ -173,8 +537,33 @@ func (f *file) ReadAt(p []byte, off int64) (int, error) {
 }
 
 func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.writeAt(p, off)
+	return n, sqliteError(err, sqlite3vfs.IOErrorWrite)
+}
+
+func (f *file) writeAt(p []byte, off int64) (int, error) {
 	f.vfs.logger.Debugw("WriteAt", "len(p)", len(p), "off", off)
 
+	if err := f.checkLock(); err != nil {
+		return 0, err
+	}
+
+	if f.copyOnWrite() {
+		err := f.beginTxn()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Also makes sure we're using the latest metadata
+	fileSize, err := f.fileSize()
+	if err != nil {
+		return 0, err
+	}
+	if f.writeBufferSectors() > 0 && !f.buffering {
+		f.buffering = true
+		f.bufferedSize = fileSize
+	}
+
 	firstSector := f.sectorForPos(off)
 
 	lastByte := off + int64(len(p)) - 1
@@ -182,24 +571,25 @@ func (f *file) WriteAt(p []byte, off int64) (int, error) {
 	lastSector := f.sectorForPos(lastByte)
 
 	var (
-		nW int
+		nW         int
+		sectorSize = f.sectorSize()
 	)
 	sectors, err := f.getSectorRange(firstSector, lastSector) // do we care if we're writing over the top?
 	if err != nil {
-		return 0, sqlite3vfs.IOErrorRead
+		return 0, readError{err: err}
 	}
 	// replace all this logic with calculating how many bytes should be in this sector
 	// then if the sector size is smaller than than
 	// allocate a new one, copy of the old data
 	// then overwrite with the new data?
 	for _, sect := range sectors {
-		lastPossibleByteForThisSector := ((sect.Index + 1) * SectorSize) - 1
-		startByteForThisSector := ((sect.Index) * SectorSize)
+		lastPossibleByteForThisSector := ((sect.Index + 1) * sectorSize) - 1
+		startByteForThisSector := ((sect.Index) * sectorSize)
 
 		currentOffset := off + int64(nW)
 		var sectorData []byte
 		if lastByte > lastPossibleByteForThisSector {
-			sectorData = make([]byte, SectorSize)
+			sectorData = make([]byte, sectorSize)
 		} else {
 			// If there's existing data, ensure the buffer is large enough to hold it
 			newlyRequiredSize := (1 + lastByte) - startByteForThisSector
@@ -214,7 +604,11 @@ func (f *file) WriteAt(p []byte, off int64) (int, error) {
 		// copy new data
 		nn := copy(sectorData[startOffset:], p[nW:])
 		sect.Data = sectorData
-		err := f.WriteSector(sect)
+		if f.buffering {
+			err = f.bufferSector(sect)
+		} else {
+			err = f.putSector(sect)
+		}
 		if err != nil {
 			f.vfs.logger.Error(err)
 			return nW, err
@@ -222,54 +616,56 @@ func (f *file) WriteAt(p []byte, off int64) (int, error) {
 		nW += nn
 	}
 
+	if newSize := off + int64(nW); newSize > fileSize {
+		if f.txn != nil {
+			f.txn.resize(newSize)
+			return nW, nil
+		}
+		if f.buffering {
+			f.bufferedSize = newSize
+			return nW, nil
+		}
+		err = f.setSize(newSize)
+		if err != nil {
+			f.vfs.logger.Error(err)
+			return nW, err
+		}
+	}
+
 	return nW, nil
 }
 
-// Sync noops as we're doing the writes directly
+// Sync writes out anything buffered and commits it in copy-on-write mode.
+// Once the API server has accepted a write it's durable, so SyncNormal and SyncDataOnly are done then.
+// SyncDataOnly still writes the size, as the data can't be read without it.
+// SyncFull also reads the metadata back to check it's what everyone else will now see.
 func (f *file) Sync(flag sqlite3vfs.SyncType) error {
-	f.vfs.logger.Debugw("Sync", "flag", flag)
-
-	return nil
+	return sqliteError(f.sync(flag), sqlite3vfs.IOError)
 }
 
-func (f *file) getCurrentLock() (sqlite3vfs.LockType, error) {
-	f.vfs.logger.Debugw("getCurrentLock")
+func (f *file) sync(flag sqlite3vfs.SyncType) error {
+	f.vfs.logger.Debugw("Sync", "flag", flag)
 
-	cm, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Get(context.TODO(), f.LockFileName(), metav1.GetOptions{})
+	if err := f.checkLock(); err != nil {
+		return err
+	}
+	err := f.flush()
 	if err != nil {
-		f.vfs.logger.Error(err)
-		return sqlite3vfs.LockNone, err
+		return err
 	}
-	currentLockString := cm.Data["lock"]
-	lockToReturn := sqlite3vfs.LockNone
-	switch currentLockString {
-	case sqlite3vfs.LockNone.String():
-		lockToReturn = sqlite3vfs.LockNone
-	case sqlite3vfs.LockShared.String():
-		lockToReturn = sqlite3vfs.LockShared
-	case sqlite3vfs.LockPending.String():
-		lockToReturn = sqlite3vfs.LockPending
-	case sqlite3vfs.LockExclusive.String():
-		lockToReturn = sqlite3vfs.LockExclusive
-	case sqlite3vfs.LockReserved.String():
-		lockToReturn = sqlite3vfs.LockReserved
-	default:
-		errStr := fmt.Sprintf("lock type unknown: %v, %v", f, currentLockString)
-		f.vfs.logger.Error(errStr)
-		return sqlite3vfs.LockNone, errors.New(errStr)
+	err = f.commit()
+	if err != nil {
+		return err
+	}
+	if flag&sqlite3vfs.SyncFull == sqlite3vfs.SyncFull {
+		return f.confirmSync()
 	}
-	f.vfs.logger.Debugw("getCurrentLock", "found current lock", lockToReturn)
-
-	return lockToReturn, nil
-}
 
-func (f *file) LockFileName() string {
-	localLockFileName := fmt.Sprintf("%s-%s", f.b32ByteFromString(f.RawName), LockFileNameSuffix)
-	return localLockFileName
+	return nil
 }
 
 func (f *file) generateSectorsLabels() {
-	fileNameLabel := string(f.b32ByteFromString(f.RawName))
+	fileNameLabel := f.id
 
 	f.SectorLabels = make(map[string]string)
 	for k, v := range CommonSectorLabel {
@@ -279,224 +675,212 @@ func (f *file) generateSectorsLabels() {
 	f.SectorLabels["relevant-file"] = fileNameLabel
 }
 
-// possibly add the validation?
-func (f *file) setLock(lock sqlite3vfs.LockType) error {
-	f.vfs.logger.Debugw("setLock", "lock", lock)
-
-	LockfileLabels := make(map[string]string)
-	for k, v := range LockfileLabel {
-		LockfileLabels[k] = v
-	}
-	fileNameLabel := string(f.b32ByteFromString(f.RawName))
-
-	LockfileLabels["relevant-file"] = fileNameLabel
-
-	lf := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: f.LockFileName(), Labels: LockfileLabels}, Data: map[string]string{"lock": lock.String(), "relevant-file": string(f.b32ByteFromString(f.RawName))}}
-
-	_, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Update(context.TODO(), lf, metav1.UpdateOptions{})
-	f.vfs.logger.Debugw("setLock", "lock", lock, "err", err)
-	if kerrors.IsNotFound(err) {
-		lf := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: f.LockFileName(), Labels: LockfileLabels}, Data: map[string]string{"lock": lock.String(), "relevant-file": string(f.b32ByteFromString(f.RawName))}}
-		_, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Create(context.TODO(), lf, metav1.CreateOptions{})
-		f.vfs.logger.Debugw("setLock has been created", "lock", lock, "err", err)
-		return err
-	}
-
-	return err
-
+func (f *file) SectorSize() int64 {
+	return f.sectorSize()
 }
 
-func (f *file) Lock(elock sqlite3vfs.LockType) error {
-	f.vfs.logger.Debugw("Lock", "elock", elock)
-	currentLock, err := f.getCurrentLock()
-	if err != nil {
-		f.vfs.logger.Error(err)
-		return err
-	}
-
-	//    UNLOCKED -> SHARED
-	//    SHARED -> RESERVED
-	//    SHARED -> (PENDING) -> EXCLUSIVE
-	//    RESERVED -> (PENDING) -> EXCLUSIVE
-	//    PENDING -> EXCLUSIVE
-
-	if elock <= currentLock {
-		return nil
-	}
-
-	//  (1) We never move from unlocked to anything higher than shared lock.
-	if currentLock == sqlite3vfs.LockNone && elock > sqlite3vfs.LockShared {
-		return errors.New("invalid lock transition requested")
-	}
-	//  (2) SQLite never explicitly requests a pendig lock.
-	if elock == sqlite3vfs.LockPending {
-		return errors.New("invalid Lock() request for state pending")
+// DeviceCharacteristics
+// We'll target 64K per configmap, so writing a whole sector is a single update.
+// That only holds for 64K pages if they never span two sectors.
+// In copy-on-write mode appends only become visible along with the new size.
+func (f *file) DeviceCharacteristics() sqlite3vfs.DeviceCharacteristic {
+	var dc sqlite3vfs.DeviceCharacteristic
+	if f.sectorSize()%SectorSize == 0 {
+		dc |= sqlite3vfs.IocapAtomic64K
 	}
-	//  (3) A shared lock is always held when a reserve lock is requested.
-	if elock == sqlite3vfs.LockReserved && currentLock != sqlite3vfs.LockShared {
-		return errors.New("can only transition to Reserved lock from Shared lock")
+	if f.copyOnWrite() {
+		dc |= sqlite3vfs.IocapSafeAppend
 	}
-
-	return f.setLock(elock)
-
+	return dc
 }
 
-func (f *file) Unlock(elock sqlite3vfs.LockType) error {
-	f.vfs.logger.Debugw("Unlock", "elock", elock)
-
-	currentLock, err := f.getCurrentLock()
-	if err != nil {
-		f.vfs.logger.Error(err)
-		return err
-	}
-
-	if elock > sqlite3vfs.LockShared {
-		f.vfs.logger.Panicf("Invalid unlock request to level %s", elock)
-	}
-
-	if currentLock < elock {
-		f.vfs.logger.Panic("Cannot unlock to a level > current lock level")
+// ShmName tells the binding which wal-index this file uses, if it can be used in WAL mode at all
+func (f *file) ShmName() string {
+	if !f.vfs.wal || !f.mainDB {
+		return ""
 	}
-
-	if elock == currentLock {
-		return nil
-	}
-
-	if elock == sqlite3vfs.LockShared {
-		return f.setLock(sqlite3vfs.LockShared)
-	}
-
-	return f.setLock(sqlite3vfs.LockNone)
+	return f.vfs.namespace + "/" + f.id
 }
 
-func (f *file) SectorSize() int64 {
-	// 64k as we're considering each sector
-	return SectorSize
+// copyOnWrite and writeBufferSectors don't apply to -wal files.
+// SQLite only syncs them on checkpoints, so other connections would never see frames kept back until then.
+func (f *file) copyOnWrite() bool {
+	return f.vfs.copyOnWrite && !f.walFile
 }
 
-// DeviceCharacteristics
-// We'll target 64K per configmap
-func (f *file) DeviceCharacteristics() sqlite3vfs.DeviceCharacteristic {
-	return sqlite3vfs.IocapAtomic64K
+func (f *file) writeBufferSectors() int {
+	if f.walFile {
+		return 0
+	}
+	return f.vfs.writeBufferSectors
 }
 
 func NewFile(name string, v *vfs) *file {
 	o := base32.NewEncoding("abcdefghijklmnopqrstuv0123456789")
 	e := o.WithPadding('x')
-	f := &file{RawName: name, vfs: v, encoding: e}
+	f := &file{RawName: name, vfs: v, encoding: e, handle: atomic.AddUint64(&v.nextHandle, 1)}
+	f.id = f.fileID()
 	f.generateSectorsLabels()
 	return f
 }
 
 // TODO, locking so other connections refused?
 func (v *vfs) Open(name string, flags sqlite3vfs.OpenFlag) (sqlite3vfs.File, sqlite3vfs.OpenFlag, error) {
+	f, flags, err := v.open(name, flags)
+	if err != nil {
+		return nil, flags, sqliteError(err, sqlite3vfs.IOError)
+	}
+	return f, flags, nil
+}
+
+func (v *vfs) open(name string, flags sqlite3vfs.OpenFlag) (*file, sqlite3vfs.OpenFlag, error) {
 	v.logger.Debugw("Open", "name", name, "flags", flags)
 
-	_, err := v.kc.ServerVersion()
+	err := v.store.Ping(v.ctx)
 	if err != nil {
 		v.logger.Error(err)
-		return nil, flags, sqlite3vfs.IOError
+		return nil, flags, err
 	}
 
-	for i := 0; i < v.retries; i++ {
-		// Check if namespace and lockfile already exist.
-		// If they don't, create them
-		// if this fails, return readonlyfs
+	// Check if namespace and lockfile already exist.
+	// If they don't, create them
+	// if this fails, return readonlyfs
 
-		f := NewFile(name, v)
+	f := NewFile(name, v)
+	f.mainDB = flags&sqlite3vfs.OpenMainDB != 0
+	f.walFile = flags&sqlite3vfs.OpenWAL != 0
 
-		// Now check for lock file
-		_, err = f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Get(context.TODO(), f.LockFileName(), metav1.GetOptions{})
-		if kerrors.IsNotFound(err) {
-			err = f.setLock(sqlite3vfs.LockNone)
-			if err != nil {
-				f.vfs.logger.Error(err)
-				continue
-			}
-		} else if err != nil {
-			return f, flags, err
+	if v.exclusive && f.mainDB {
+		// The lockfile isn't used while we hold the lease
+		f.lease, err = v.acquireLease(f)
+		if err != nil {
+			v.logger.Errorw("Failed to acquire lease", "name", name, "err", err)
+			return nil, flags, err
 		}
-
-		cms, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labels.SelectorFromSet(f.SectorLabels).String()})
-		names := []string{}
-		for _, n := range cms.Items {
-			names = append(names, n.Name)
+	} else {
+		// Now check for lock file
+		_, err = f.vfs.store.GetLock(f.vfs.ctx, f.LockFileName())
+		if err == errRecordNotFound {
+			err = f.createLockFile(f.vfs.ctx)
 		}
-
-		v.logger.Debugw("Checked for existing sectors", "sectors", names, "len(cms.Items)", len(cms.Items), "err", err)
 		if err != nil {
-			v.logger.Debugw("err response for data configmaps", "error", err)
+			v.logger.Errorw("Failed to get or create lockfile", "name", name, "err", err)
+			return nil, flags, err
 		}
-		if len(cms.Items) == 0 {
-			err := f.WriteSector(&Sector{Index: 0, Labels: f.SectorLabels})
-			v.logger.Debugw("wrote an empty sector", "error", err)
-
-			if err != nil {
-				v.logger.Error(err)
-				return f, flags, err
-
-			}
+	}
 
+	// Make sure there's metadata, which is what makes a new file exist, creating it for older files too.
+	// Another connection can beat us to creating it, in which case we read theirs.
+	// The store already retries API errors, so only races are tried again here.
+	for i := 0; ; i++ {
+		_, err = f.getMetadata()
+		if err != errConflict || i >= v.retry.Retries || v.retry.wait(v.ctx, i, nil) != nil {
+			break
 		}
-		v.logger.Debugw("Opened file successfully", "name", name, "flags", flags)
-
-		return f, flags, nil
-
 	}
-	v.logger.Debugw("Failed to open file")
-	return nil, flags, errors.New("failed to get/create file metadata too many times due to races")
+	if err != nil {
+		v.logger.Errorw("Failed to get or create file metadata", "name", name, "err", err)
+		if f.lease != nil {
+			v.releaseLease(f.lease)
+		}
+		return nil, flags, err
+	}
+	v.logger.Debugw("Opened file successfully", "name", name, "flags", flags)
 
+	return f, flags, nil
 }
 
 func (v *vfs) Delete(name string, dirSync bool) error {
+	return sqliteError(v.delete(name, dirSync), sqlite3vfs.IOError)
+}
+
+func (v *vfs) delete(name string, dirSync bool) error {
 	v.logger.Debugw("Delete", "name", name, "dirSync", dirSync)
 	// in case we're racing another client
 	f := NewFile(name, v)
-	for i := 0; i <= f.vfs.retries; i++ {
+	if v.cache != nil {
+		defer v.cache.invalidateFile(f.fileKey())
+	}
+	// The store already retries API errors, so only losing a race to another client is tried again here
+	for i := 0; i <= f.vfs.retry.Retries; i++ {
+		if i > 0 && v.retry.wait(v.ctx, i-1, nil) != nil {
+			break
+		}
+
+		// Empty the file before removing anything, so if we die part way through
+		// what's left isn't mistaken for a hot journal
+		err := f.empty()
+		if err == errConflict {
+			v.logger.Warnw("Delete raced another client emptying the file", "name", name)
+			continue
+		} else if err != nil {
+			v.logger.Errorw("Delete failed to empty file", "name", name, "err", err)
+			return err
+		}
 
-		v.logger.Debugw("Deleting configmaps representing this filename", "name", name)
-		cms, err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labels.SelectorFromSet(f.SectorLabels).String()})
+		v.logger.Debugw("Deleting sectors representing this filename", "name", name)
+		sectors, err := f.vfs.store.ListSectors(f.vfs.ctx, f.SectorLabels)
 		if err != nil {
-			v.logger.Errorw("Delete's get cms failed", "err", err)
+			v.logger.Errorw("Delete's list sectors failed", "err", err)
+			return err
 		}
-		v.logger.Debugw("Delete get cms", "cms", cms, "err", err)
-		aDeleteFailed := false
-
-		for _, c := range cms.Items {
-			err := f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Delete(context.TODO(), c.Name, metav1.DeleteOptions{})
-			if err != nil {
-				v.logger.Errorw("Delete failed to delete cm", "cm", c, "err", err)
-				aDeleteFailed = true
-				continue
+		v.logger.Debugw("Delete list sectors", "len(sectors)", len(sectors), "err", err)
+
+		for _, sect := range sectors {
+			err := f.vfs.store.DeleteSector(f.vfs.ctx, sect.Name)
+			if err != nil && err != ErrSectorMissing {
+				v.logger.Errorw("Delete failed to delete sector", "sector", sect.Name, "err", err)
+				return err
 			}
-			v.logger.Debugw("Deleted configmap", "configmap", c)
+			v.logger.Debugw("Deleted sector", "sector", sect.Name)
 
 		}
-		if aDeleteFailed {
-			continue
+
+		v.logger.Debugw("Deleting metadata for this filename", "name", name)
+		err = f.deleteMetadata()
+		if err != nil {
+			f.vfs.logger.Error(err)
+			return err
 		}
 
 		v.logger.Debugw("Deleting lockfile for this filename", "name", name)
-		err = f.vfs.kc.CoreV1().ConfigMaps(f.vfs.namespace).Delete(context.TODO(), f.LockFileName(), metav1.DeleteOptions{})
-		if kerrors.IsNotFound(err) || err == nil {
-			return nil
-		} else {
+		err = f.vfs.store.DeleteLock(f.vfs.ctx, f.LockFileName())
+		if err != nil && err != errRecordNotFound {
 			f.vfs.logger.Error(err)
-			continue
+			return err
 		}
+
+		// Make sure the delete is visible before telling SQLite it's done
+		if dirSync {
+			_, err = f.vfs.store.GetMetadata(f.vfs.ctx, f.MetadataName())
+			if err == nil {
+				f.vfs.logger.Warnw("File still exists after being deleted", "name", name)
+				continue
+			} else if err != errRecordNotFound {
+				f.vfs.logger.Errorw("Delete couldn't check the file is gone", "name", name, "err", err)
+				return err
+			}
+		}
+
+		return nil
 	}
 	f.vfs.logger.Errorw("Failed to delete file", "filename", name, "dirSync", dirSync)
-	return sqlite3vfs.IOError
+	return errConflict
 }
 
 // Access tests for access permission. Returns true if the requested permission is available.
+// Like unix, files only exist if they have some data in them, which is how SQLite finds hot journals.
 func (v *vfs) Access(name string, flags sqlite3vfs.AccessFlag) (bool, error) {
 	v.logger.Debugw("Access", "name", name, "flags", flags)
-	// Required because SQLITE3 fails with "unable to open database file: invalid argument" when it tries to read this when they're empty, and we return io.EOF
-	if strings.HasSuffix(name, "-wal") || strings.HasSuffix(name, "-journal") {
-		return false, nil
+	f := NewFile(name, v)
+	exists, err := f.exists()
+	if err != nil {
+		v.logger.Errorw("Access failed", "name", name, "err", err)
+		return false, sqliteError(err, sqlite3vfs.IOError)
 	}
-	return true, nil
+	v.logger.Debugw("Access", "name", name, "exists", exists)
+
+	return exists, nil
 }
 
 // FullPathname returns the canonicalized version of name.
@@ -504,19 +888,3 @@ func (v *vfs) Access(name string, flags sqlite3vfs.AccessFlag) (bool, error) {
 func (v *vfs) FullPathname(name string) string {
 	return name
 }
-
-// CheckReservedLock
-// TODO actually fulfil this
-func (f *file) CheckReservedLock() (bool, error) {
-
-	currentLock, err := f.getCurrentLock()
-	if err != nil {
-		f.vfs.logger.Error(err)
-		return false, err
-	}
-	if currentLock > sqlite3vfs.LockNone {
-		// we hold a lock
-		return true, nil
-	}
-	return false, nil
-}
@@ -0,0 +1,455 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/psanford/sqlite3vfs"
+	"go.uber.org/zap/zaptest"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "test"
+
+func newTestVFS(t *testing.T, opts ...Option) (*vfs, *fake.Clientset) {
+	t.Helper()
+	kc := fake.NewSimpleClientset()
+	trackResourceVersions(kc)
+	// Stop lock renewals and watches, which would otherwise log after the test has finished
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewVFS(kc, testNamespace, zaptest.NewLogger(t).Sugar(), 2, append([]Option{WithContext(ctx)}, opts...)...), kc
+}
+
+// trackResourceVersions makes the fake clientset behave like the API server,
+// setting a resourceVersion on every write and rejecting updates from a stale version
+func trackResourceVersions(kc *fake.Clientset) {
+	trackResourceVersionsOf(kc, "configmaps", "secrets", "leases")
+}
+
+// fakeClient is what the fake clientset and fake dynamic client have in common
+type fakeClient interface {
+	PrependReactor(verb, resource string, reaction k8stesting.ReactionFunc)
+	Tracker() k8stesting.ObjectTracker
+}
+
+func trackResourceVersionsOf(kc fakeClient, resources ...string) {
+	var (
+		mu      sync.Mutex
+		version int64
+	)
+	track := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Update actions have the same methods as create actions
+		a, ok := action.(k8stesting.CreateAction)
+		if !ok {
+			return false, nil, nil
+		}
+		obj := a.GetObject().DeepCopyObject()
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		switch action.GetVerb() {
+		case "create":
+			version += 1
+			objMeta.SetResourceVersion(strconv.FormatInt(version, 10))
+			err := kc.Tracker().Create(a.GetResource(), obj, a.GetNamespace())
+			return true, obj, err
+		case "update":
+			existing, err := kc.Tracker().Get(a.GetResource(), a.GetNamespace(), objMeta.GetName())
+			if err != nil {
+				return true, nil, err
+			}
+			existingMeta, err := meta.Accessor(existing)
+			if err != nil {
+				return true, nil, err
+			}
+			if objMeta.GetResourceVersion() != "" && objMeta.GetResourceVersion() != existingMeta.GetResourceVersion() {
+				return true, nil, kerrors.NewConflict(a.GetResource().GroupResource(), objMeta.GetName(), errors.New("stale resourceVersion"))
+			}
+			version += 1
+			objMeta.SetResourceVersion(strconv.FormatInt(version, 10))
+			err = kc.Tracker().Update(a.GetResource(), obj, a.GetNamespace())
+			return true, obj, err
+		}
+		return false, nil, nil
+	}
+	for _, resource := range resources {
+		kc.PrependReactor("*", resource, track)
+	}
+}
+
+func openTestFile(t *testing.T, v *vfs, name string) *file {
+	t.Helper()
+	f, _, err := v.Open(name, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", name, err)
+	}
+	return f.(*file)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func countConfigMaps(t *testing.T, kc *fake.Clientset) int {
+	t.Helper()
+	cms, err := kc.CoreV1().ConfigMaps(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(cms.Items)
+}
+
+func TestOpenEmptyFile(t *testing.T) {
+	v, _ := newTestVFS(t)
+	f := openTestFile(t, v, "empty.db")
+
+	size, err := f.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Errorf("new file has size %d, expected 0", size)
+	}
+
+	n, err := f.ReadAt(make([]byte, 10), 0)
+	if n != 0 || err != io.EOF {
+		t.Errorf("ReadAt on empty file returned %d, %v, expected 0, io.EOF", n, err)
+	}
+}
+
+func TestWriteAtReadAt(t *testing.T) {
+	v, _ := newTestVFS(t)
+	f := openTestFile(t, v, "rw.db")
+
+	// Spans three sectors, starting part way through the first
+	data := randomBytes(t, 2*SectorSize+10)
+	off := int64(SectorSize - 5)
+	n, err := f.WriteAt(data, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Fatalf("WriteAt wrote %d bytes, expected %d", n, len(data))
+	}
+
+	size, err := f.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != off+int64(len(data)) {
+		t.Errorf("FileSize is %d, expected %d", size, off+int64(len(data)))
+	}
+
+	got := make([]byte, len(data))
+	n, err = f.ReadAt(got, off)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if n != len(data) || !bytes.Equal(got, data) {
+		t.Errorf("ReadAt returned %d bytes which didn't match what was written", n)
+	}
+
+	// Overwrite the middle and check the surrounding data survives
+	patch := []byte("overwritten")
+	_, err = f.WriteAt(patch, SectorSize+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[SectorSize+100-off:], patch)
+
+	got = make([]byte, len(data))
+	_, err = f.ReadAt(got, off)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadAt after overwrite didn't match")
+	}
+
+	// Reading past the end is a short read
+	n, err = f.ReadAt(make([]byte, 100), size-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("ReadAt past the end returned %d, %v, expected 10, io.EOF", n, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	v, kc := newTestVFS(t)
+	f := openTestFile(t, v, "truncate.db")
+
+	data := randomBytes(t, 3*SectorSize+10)
+	_, err := f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := countConfigMaps(t, kc)
+
+	newSize := int64(SectorSize + 20)
+	err = f.Truncate(newSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := f.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != newSize {
+		t.Errorf("FileSize after Truncate is %d, expected %d", size, newSize)
+	}
+	if after := countConfigMaps(t, kc); after != before-2 {
+		t.Errorf("expected Truncate to remove 2 sectors, went from %d to %d configmaps", before, after)
+	}
+
+	got := make([]byte, newSize)
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[:newSize]) {
+		t.Error("data before the truncation point changed")
+	}
+
+	// Growing is a no-op
+	err = f.Truncate(newSize * 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ = f.FileSize()
+	if size != newSize {
+		t.Errorf("Truncate to a larger size changed the size to %d", size)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	v, kc := newTestVFS(t)
+	f := openTestFile(t, v, "delete.db")
+	other := openTestFile(t, v, "other.db")
+
+	_, err := f.WriteAt(randomBytes(t, 2*SectorSize), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.WriteAt([]byte("keep me"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := countConfigMaps(t, kc)
+
+	// Emptying the file has to be on top of the metadata Delete read
+	blind := 0
+	kc.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, _ := meta.Accessor(action.(k8stesting.UpdateAction).GetObject())
+		if obj.GetName() == f.MetadataName() && obj.GetResourceVersion() == "" {
+			blind++
+		}
+		return false, nil, nil
+	})
+
+	err = v.Delete("delete.db", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 sectors, metadata and the lockfile
+	if after := countConfigMaps(t, kc); after != before-4 {
+		t.Errorf("expected Delete to remove 4 configmaps, went from %d to %d", before, after)
+	}
+
+	got := make([]byte, 7)
+	_, err = other.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if string(got) != "keep me" {
+		t.Errorf("other file was changed by Delete, got %q", got)
+	}
+	if blind > 0 {
+		t.Errorf("Delete overwrote the metadata without a resourceVersion %d times", blind)
+	}
+
+	// Deleting something that doesn't exist is fine, and doesn't create it
+	before = countConfigMaps(t, kc)
+	if err := v.Delete("missing.db", false); err != nil {
+		t.Error(err)
+	}
+	if after := countConfigMaps(t, kc); after != before {
+		t.Errorf("deleting a missing file went from %d to %d configmaps", before, after)
+	}
+}
+
+func TestAccessDoesntWrite(t *testing.T) {
+	v, kc := newTestVFS(t)
+	f := openTestFile(t, v, "access.db")
+	if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Like a file from before metadata
+	if err := f.deleteMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := 0
+	for _, verb := range []string{"create", "update"} {
+		kc.PrependReactor(verb, "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			writes++
+			return false, nil, nil
+		})
+	}
+	for _, name := range []string{"access.db", "missing.db"} {
+		exists, err := v.Access(name, sqlite3vfs.AccessExists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != (name == "access.db") {
+			t.Errorf("Access says %s exists is %t", name, exists)
+		}
+	}
+	if writes > 0 {
+		t.Errorf("Access made %d writes", writes)
+	}
+}
+
+func TestAccessJournalDoesntList(t *testing.T) {
+	v, kc := newTestVFS(t)
+	lists := 0
+	kc.PrependReactor("list", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lists++
+		return false, nil, nil
+	})
+	// SQLite checks for a hot journal like this on every transaction
+	for _, name := range []string{"list.db-journal", "list.db-wal"} {
+		exists, err := v.Access(name, sqlite3vfs.AccessExists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("Access says %s exists", name)
+		}
+	}
+	if lists > 0 {
+		t.Errorf("Access listed sectors %d times for journals", lists)
+	}
+}
+
+func TestFileIDHashedOver35Bytes(t *testing.T) {
+	v, _ := newTestVFS(t)
+	for n, hashed := range map[int]bool{35: false, 36: true} {
+		id := NewFile(strings.Repeat("a", n), v).fileID()
+		if strings.HasPrefix(id, "z") != hashed {
+			t.Errorf("%d byte name has ID %q, expected hashed to be %t", n, id, hashed)
+		}
+	}
+}
+
+func TestLongFileNames(t *testing.T) {
+	v, kc := newTestVFS(t, WithCopyOnWrite())
+	names := []string{"/var/lib/app/some/deep/path/tenant-1234.db", "/" + strings.Repeat("very-long-directory/", 15) + "file.db"}
+	for _, name := range names {
+		f := openTestFile(t, v, name)
+		for i := 0; i < 2; i++ {
+			if _, err := f.WriteAt([]byte(name), int64(i)*SectorSize); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Sync(sqlite3vfs.SyncNormal); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Lock(sqlite3vfs.LockShared); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(name))
+		if _, err := f.ReadAt(got, SectorSize); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if string(got) != name {
+			t.Errorf("read back %q, expected %q", got, name)
+		}
+		if err := f.Unlock(sqlite3vfs.LockNone); err != nil {
+			t.Fatal(err)
+		}
+		r, err := v.store.GetMetadata(context.TODO(), f.MetadataName())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Data["filename"] != name {
+			t.Errorf("metadata has filename %q, expected %q", r.Data["filename"], name)
+		}
+	}
+
+	cms, err := kc.CoreV1().ConfigMaps(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cm := range cms.Items {
+		for _, msg := range validation.IsDNS1123Subdomain(cm.Name) {
+			t.Errorf("invalid name %s: %s", cm.Name, msg)
+		}
+		for k, v := range cm.Labels {
+			for _, msg := range validation.IsValidLabelValue(v) {
+				t.Errorf("invalid label %s=%s on %s: %s", k, v, cm.Name, msg)
+			}
+		}
+	}
+
+	// Short names are still named after their base32, so existing files can be found
+	short := NewFile("file2.db", &vfs{})
+	if short.id != string(short.b32ByteFromString("file2.db")) {
+		t.Errorf("short name got id %s", short.id)
+	}
+}
+
+func TestPutMetadataWithoutVersion(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	trackResourceVersions(kc)
+	logger := zaptest.NewLogger(t).Sugar()
+	crd, _, _ := newTestCRDStore(t)
+	for name, store := range map[string]SectorStore{
+		"configmap": NewConfigMapStore(kc, testNamespace, logger),
+		"secret":    NewSecretStore(kc, testNamespace, logger),
+		"crd":       crd,
+	} {
+		t.Run(name, func(t *testing.T) {
+			record := func(size string) *Record {
+				return &Record{Name: "race-metadata", Data: map[string]string{"filename": "race.db", "size": size, "sectors": "1", "version": "1"}}
+			}
+			if err := store.PutMetadata(context.TODO(), record("10")); err != nil {
+				t.Fatal(err)
+			}
+			// Someone else creating the same file at the same time
+			if err := store.PutMetadata(context.TODO(), record("20")); err != errConflict {
+				t.Errorf("creating metadata which exists returned %v, expected %v", err, errConflict)
+			}
+			r, err := store.GetMetadata(context.TODO(), "race-metadata")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Data["size"] != "10" {
+				t.Errorf("metadata was overwritten, size is %s", r.Data["size"])
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/psanford/sqlite3vfs
+
+go 1.15
+
+require (
+	github.com/google/go-cmp v0.5.6
+	github.com/mattn/go-sqlite3 v1.14.8
+)
@@ -0,0 +1,206 @@
+package sqlite3vfs
+
+/*
+   #include "sqlite3vfs.h"
+   #include <stdlib.h>
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// ShmFile is implemented by files which can be used in WAL mode.
+//
+// The wal-index is kept in this process's memory, shared by every open file with the same ShmName,
+// so WAL mode is only safe when every connection to the database is in this process.
+type ShmFile interface {
+	File
+
+	// ShmName identifies the database the wal-index belongs to.
+	// Files which return "" don't support WAL mode.
+	ShmName() string
+}
+
+// shmNode is the wal-index of one database
+type shmNode struct {
+	name    string
+	refs    int
+	regions []unsafe.Pointer
+	// shared counts the connections holding each lock shared, excl is set while one holds it exclusively
+	shared [C.SQLITE_SHM_NLOCK]int
+	excl   [C.SQLITE_SHM_NLOCK]bool
+}
+
+// shmConn is one open file's view of a shmNode, with the locks it holds as bitmasks
+type shmConn struct {
+	node   *shmNode
+	shared uint16
+	excl   uint16
+}
+
+var (
+	shmMux   sync.Mutex
+	shmNodes = make(map[string]*shmNode)
+	shmConns = make(map[uint64]*shmConn)
+)
+
+func shmFileFromC(cfile *C.sqlite3_file) (uint64, ShmFile) {
+	s3vfsFile := (*C.s3vfsFile)(unsafe.Pointer(cfile))
+	fileID := uint64(s3vfsFile.id)
+
+	fileMux.Lock()
+	file := fileMap[fileID]
+	fileMux.Unlock()
+
+	shmFile, ok := file.(ShmFile)
+	if !ok {
+		return fileID, nil
+	}
+	return fileID, shmFile
+}
+
+//export goVFSHasShm
+func goVFSHasShm(cfile *C.sqlite3_file) C.int {
+	_, file := shmFileFromC(cfile)
+	if file == nil || file.ShmName() == "" {
+		return 0
+	}
+	return 1
+}
+
+// shmConnect returns the connection of cfile, attaching it to its wal-index on first use.
+// Must be called with shmMux held.
+func shmConnect(cfile *C.sqlite3_file) *shmConn {
+	fileID, file := shmFileFromC(cfile)
+	if conn, ok := shmConns[fileID]; ok {
+		return conn
+	}
+	if file == nil {
+		return nil
+	}
+
+	name := file.ShmName()
+	node, ok := shmNodes[name]
+	if !ok {
+		node = &shmNode{name: name}
+		shmNodes[name] = node
+	}
+	node.refs++
+	conn := &shmConn{node: node}
+	shmConns[fileID] = conn
+	return conn
+}
+
+//export goVFSShmMap
+func goVFSShmMap(cfile *C.sqlite3_file, iPg C.int, pgsz C.int, bExtend C.int, pp *unsafe.Pointer) C.int {
+	shmMux.Lock()
+	defer shmMux.Unlock()
+
+	conn := shmConnect(cfile)
+	if conn == nil {
+		return errToC(IOErrorShmMap)
+	}
+	node := conn.node
+
+	for len(node.regions) <= int(iPg) {
+		if bExtend == 0 {
+			*pp = nil
+			return sqliteOK
+		}
+		region := C.calloc(1, C.size_t(pgsz))
+		if region == nil {
+			return errToC(NoMemError)
+		}
+		node.regions = append(node.regions, region)
+	}
+	*pp = node.regions[iPg]
+
+	return sqliteOK
+}
+
+//export goVFSShmLock
+func goVFSShmLock(cfile *C.sqlite3_file, offset C.int, n C.int, flags C.int) C.int {
+	shmMux.Lock()
+	defer shmMux.Unlock()
+
+	conn := shmConnect(cfile)
+	if conn == nil {
+		return errToC(IOErrorShmLock)
+	}
+	node := conn.node
+	mask := uint16((1<<uint(n))-1) << uint(offset)
+
+	switch {
+	case flags&C.SQLITE_SHM_UNLOCK != 0:
+		for i := int(offset); i < int(offset+n); i++ {
+			if conn.shared&(1<<uint(i)) != 0 {
+				node.shared[i]--
+			}
+			if conn.excl&(1<<uint(i)) != 0 {
+				node.excl[i] = false
+			}
+		}
+		conn.shared &^= mask
+		conn.excl &^= mask
+	case flags&C.SQLITE_SHM_SHARED != 0:
+		// SQLite only asks for shared locks one at a time
+		if conn.shared&mask != 0 {
+			return sqliteOK
+		}
+		if node.excl[offset] {
+			return errToC(BusyError)
+		}
+		node.shared[offset]++
+		conn.shared |= mask
+	default:
+		for i := int(offset); i < int(offset+n); i++ {
+			if conn.excl&(1<<uint(i)) != 0 {
+				continue
+			}
+			if node.excl[i] || node.shared[i] > 0 {
+				return errToC(BusyError)
+			}
+		}
+		for i := int(offset); i < int(offset+n); i++ {
+			node.excl[i] = true
+		}
+		conn.excl |= mask
+	}
+
+	return sqliteOK
+}
+
+//export goVFSShmUnmap
+func goVFSShmUnmap(cfile *C.sqlite3_file, deleteFlag C.int) C.int {
+	shmMux.Lock()
+	defer shmMux.Unlock()
+
+	s3vfsFile := (*C.s3vfsFile)(unsafe.Pointer(cfile))
+	fileID := uint64(s3vfsFile.id)
+	conn, ok := shmConns[fileID]
+	if !ok {
+		return sqliteOK
+	}
+	delete(shmConns, fileID)
+
+	node := conn.node
+	for i := 0; i < len(node.shared); i++ {
+		if conn.shared&(1<<uint(i)) != 0 {
+			node.shared[i]--
+		}
+		if conn.excl&(1<<uint(i)) != 0 {
+			node.excl[i] = false
+		}
+	}
+	node.refs--
+	if node.refs == 0 {
+		for _, region := range node.regions {
+			C.free(region)
+		}
+		delete(shmNodes, node.name)
+	}
+
+	return sqliteOK
+}